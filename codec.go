@@ -0,0 +1,341 @@
+package mq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Prefix is zero padded unixtime micro and sequence so that redis sorts members lexicographically.
+	// Its fields are separated by fieldSeparator and the body follows bodySeparator.
+	// Unixtime micro has 16 digits until 2286 and is padded enough for int64.
+	timeLength     = 20
+	seqLength      = 4
+	seqModulo      = 10000
+	nodeLength     = 8
+	fieldSeparator = "."
+	bodySeparator  = ":"
+
+	// Legacy prefix written by the first release is 16 digits unixtime micro directly followed by the body
+	legacyTimeLength = 16
+)
+
+// Message is the data stored as a sorted set member
+type Message struct {
+	// Timestamp is unixtime micro when the message is put
+	Timestamp int64 `json:"ts"`
+	// Seq distinguishes messages put in the same microsecond
+	Seq uint32 `json:"seq"`
+	// Node is hex digits identifying the broker which put the message,
+	// so that messages put by different processes in the same microsecond are distinct
+	Node string `json:"node,omitempty"`
+	// Priority is the priority when the member was written for readers in other languages. Only JSONCodec
+	// and GobCodec store it. The score of the member is the current priority since aging, decay
+	// and UpdatePriority don't rewrite members.
+	Priority float64 `json:"priority"`
+	// Deliveries is the number of failed deliveries
+	Deliveries int `json:"deliveries"`
+	// ExpiresAt is unixtime micro when the message expires. Zero means never.
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// ID identifies the message across deliveries. It is derived from the first stamp when empty.
+	ID string `json:"id,omitempty"`
+	// Headers carries metadata like routing keys and trace IDs
+	Headers map[string]string `json:"headers,omitempty"`
+	// Compression is how Body is compressed
+	Compression Compression `json:"comp,omitempty"`
+	Body        []byte      `json:"body"`
+}
+
+// Compression is an algorithm compressing message bodies
+type Compression int
+
+const (
+	// CompressionNone stores bodies as they are
+	CompressionNone Compression = iota
+	// CompressionGzip compresses bodies with gzip
+	CompressionGzip
+)
+
+// compress returns m with its body compressed by c
+func (m Message) compress(c Compression) (Message, error) {
+	switch c {
+	case CompressionNone:
+		return m, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(m.Body); err != nil {
+			return m, err
+		}
+		if err := w.Close(); err != nil {
+			return m, err
+		}
+		m.Body = buf.Bytes()
+		m.Compression = c
+		return m, nil
+	default:
+		return m, fmt.Errorf("Unknown compression %d", c)
+	}
+}
+
+// decompress returns m with its body decompressed
+func (m Message) decompress() (Message, error) {
+	switch m.Compression {
+	case CompressionNone:
+		return m, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(m.Body))
+		if err != nil {
+			return m, err
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return m, err
+		}
+		m.Body = body
+		m.Compression = CompressionNone
+		return m, nil
+	default:
+		return m, fmt.Errorf("Unknown compression %d", m.Compression)
+	}
+}
+
+// id returns ID or derives one from the stamp and the body
+func (m Message) id() string {
+	if m.ID != "" {
+		return m.ID
+	}
+
+	sum := sha1.Sum(m.Body)
+	return fmt.Sprintf("%d-%0*d%s-%s", m.Timestamp, seqLength, m.Seq, m.Node, hex.EncodeToString(sum[:4]))
+}
+
+func (m Message) expired(now int64) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now
+}
+
+// Codec encodes messages into sorted set members and decodes them back.
+// Members with the same priority are ordered lexicographically by redis,
+// so only PrefixCodec guarantees FIFO order within a priority.
+type Codec interface {
+	Encode(Message) ([]byte, error)
+	Decode([]byte) (Message, error)
+}
+
+// PrefixCodec stores the body behind a numeric prefix like
+// "<unixtime micro>.<sequence><node>.<deliveries>[.<expires at>[.<headers>[.<compression>[.<id>]]]]:<body>".
+// Headers are encoded as a base64 query string and ID as base64. It is the default codec.
+type PrefixCodec struct{}
+
+// GobCodec stores messages encoded with encoding/gob
+type GobCodec struct{}
+
+// JSONCodec stores messages encoded with encoding/json for non-Go consumers like
+// {"ts":<unixtime micro>,"seq":<sequence>,"node":"<hex>","priority":<priority>,"deliveries":<deliveries>,"body":"<base64>"}.
+// The optional fields "node", "exp", "id", "headers" and "comp" are omitted when empty, and messages put by
+// a broker always have "node". "priority" is the priority when the member was written. The current one is
+// the score of the member, which is negated unless Config.LowerIsHigher is set.
+type JSONCodec struct{}
+
+func getMember(m Message) string {
+	// Added prefix to let redis sort them lexicographically
+	prefix := fmt.Sprintf("%0*d", timeLength, m.Timestamp)
+	// Sequence and node keep members distinct for the same body in the same microsecond
+	prefix += fieldSeparator + fmt.Sprintf("%0*d", seqLength, m.Seq%seqModulo) + m.Node
+	prefix += fieldSeparator + strconv.Itoa(m.Deliveries)
+	// Optional fields are written up to the last one set
+	hasID := m.ID != ""
+	compressed := m.Compression != CompressionNone || hasID
+	hasHeaders := len(m.Headers) != 0 || compressed
+	if m.ExpiresAt != 0 || hasHeaders {
+		prefix += fieldSeparator + strconv.FormatInt(m.ExpiresAt, 10)
+	}
+	if hasHeaders {
+		prefix += fieldSeparator + encodeHeaders(m.Headers)
+	}
+	if compressed {
+		prefix += fieldSeparator + strconv.Itoa(int(m.Compression))
+	}
+	if hasID {
+		prefix += fieldSeparator + base64.RawURLEncoding.EncodeToString([]byte(m.ID))
+	}
+
+	return prefix + bodySeparator + string(m.Body)
+}
+
+// getBody returns the body of member encoded by PrefixCodec or nil if it is malformed
+func getBody(member string) []byte {
+	m, err := PrefixCodec{}.Decode([]byte(member))
+	if err != nil {
+		return nil
+	}
+
+	return m.Body
+}
+
+// Encode encodes m into the prefixed format
+func (PrefixCodec) Encode(m Message) ([]byte, error) {
+	return []byte(getMember(m)), nil
+}
+
+// Decode decodes the prefixed format.
+// Members written by the first release as unixtime micro followed by the body are decoded as well.
+func (PrefixCodec) Decode(data []byte) (m Message, err error) {
+	member := string(data)
+	// Zero padding leads the prefix while legacy timestamps have no leading zeros
+	if len(member) == 0 || member[0] != '0' {
+		return decodeLegacyMember(member)
+	}
+
+	sep := strings.Index(member, bodySeparator)
+	if sep < 0 {
+		err = errors.New("Member has no body separator")
+		return
+	}
+
+	fields := strings.Split(member[:sep], fieldSeparator)
+	if len(fields) < 3 || len(fields) > 7 {
+		err = fmt.Errorf("Member prefix has %d fields", len(fields))
+		return
+	}
+
+	m.Timestamp, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	if len(fields[1]) < seqLength {
+		err = errors.New("Member sequence is too short")
+		return
+	}
+	seq, err := strconv.ParseUint(fields[1][:seqLength], 10, 32)
+	if err != nil {
+		return
+	}
+	m.Seq = uint32(seq)
+	m.Node = fields[1][seqLength:]
+	m.Deliveries, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return
+	}
+	if len(fields) >= 4 {
+		m.ExpiresAt, err = strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	if len(fields) >= 5 {
+		m.Headers, err = decodeHeaders(fields[4])
+		if err != nil {
+			return
+		}
+	}
+	if len(fields) >= 6 {
+		var c int
+		c, err = strconv.Atoi(fields[5])
+		if err != nil {
+			return
+		}
+		m.Compression = Compression(c)
+	}
+	if len(fields) == 7 {
+		var id []byte
+		id, err = base64.RawURLEncoding.DecodeString(fields[6])
+		if err != nil {
+			return
+		}
+		m.ID = string(id)
+	}
+	m.Body = []byte(member[sep+len(bodySeparator):])
+
+	return
+}
+
+// encodeHeaders encodes headers without separators of the prefix
+func encodeHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+
+	values := url.Values{}
+	for k, v := range headers {
+		values.Set(k, v)
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(values.Encode()))
+}
+
+func decodeHeaders(field string) (map[string]string, error) {
+	if field == "" {
+		return nil, nil
+	}
+
+	query, err := base64.RawURLEncoding.DecodeString(field)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(query))
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string, len(values))
+	for k := range values {
+		headers[k] = values.Get(k)
+	}
+
+	return headers, nil
+}
+
+// decodeLegacyMember decodes members of the first release which have neither sequences nor deliveries
+func decodeLegacyMember(member string) (m Message, err error) {
+	if len(member) < legacyTimeLength {
+		err = errors.New("Member is shorter than its prefix")
+		return
+	}
+
+	m.Timestamp, err = strconv.ParseInt(member[:legacyTimeLength], 10, 64)
+	if err != nil {
+		return
+	}
+	m.Body = []byte(member[legacyTimeLength:])
+
+	return
+}
+
+// Encode encodes m with encoding/gob
+func (GobCodec) Encode(m Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Decode decodes data with encoding/gob
+func (GobCodec) Decode(data []byte) (m Message, err error) {
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&m)
+	return
+}
+
+// Encode encodes m with encoding/json
+func (JSONCodec) Encode(m Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// Decode decodes data with encoding/json
+func (JSONCodec) Decode(data []byte) (m Message, err error) {
+	err = json.Unmarshal(data, &m)
+	return
+}
@@ -0,0 +1,290 @@
+package mq
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCodec(t *testing.T) {
+	Convey("Given a message", t, func() {
+		m := Message{
+			Timestamp:  1479459537280998,
+			Seq:        12,
+			Deliveries: 3,
+			Body:       []byte("This is codec data for tests"),
+		}
+
+		for _, codec := range []Codec{PrefixCodec{}, GobCodec{}, JSONCodec{}} {
+			Convey("When encoding and decoding it with "+fmt.Sprintf("%T", codec), func() {
+				data, err := codec.Encode(m)
+				So(err, ShouldBeNil)
+
+				decoded, err := codec.Decode(data)
+
+				Convey("Then the same message should be returned", func() {
+					So(err, ShouldBeNil)
+					So(decoded, ShouldResemble, m)
+				})
+			})
+		}
+
+		Convey("When encoding timestamps around the boundary gaining a digit with PrefixCodec", func() {
+			before := m
+			before.Timestamp = 9999999999999999
+			after := m
+			after.Timestamp = 10000000000000000
+
+			beforeData, _ := PrefixCodec{}.Encode(before)
+			afterData, _ := PrefixCodec{}.Encode(after)
+			decodedBefore, errBefore := PrefixCodec{}.Decode(beforeData)
+			decodedAfter, errAfter := PrefixCodec{}.Decode(afterData)
+
+			Convey("Then both should be decoded and sorted in order", func() {
+				So(errBefore, ShouldBeNil)
+				So(errAfter, ShouldBeNil)
+				So(decodedBefore, ShouldResemble, before)
+				So(decodedAfter, ShouldResemble, after)
+				So(string(beforeData) < string(afterData), ShouldBeTrue)
+			})
+		})
+
+		Convey("When decoding members written by the first release with PrefixCodec", func() {
+			members := map[string]string{
+				"1700000000000000hello world": "hello world",
+				"1700000000000000{\"a\":1}":   "{\"a\":1}",
+				"17000000000000001234567890":  "1234567890",
+				"1700000000000000":            "",
+			}
+
+			Convey("Then the bodies should follow the timestamps without sequences and deliveries", func() {
+				for member, body := range members {
+					decoded, err := PrefixCodec{}.Decode([]byte(member))
+					So(err, ShouldBeNil)
+					So(decoded.Timestamp, ShouldEqual, 1700000000000000)
+					So(decoded.Seq, ShouldEqual, 0)
+					So(decoded.Deliveries, ShouldEqual, 0)
+					So(string(decoded.Body), ShouldEqual, body)
+				}
+			})
+		})
+
+		Convey("When decoding a member shorter than the first release prefix with PrefixCodec", func() {
+			_, err := PrefixCodec{}.Decode([]byte("1700000000"))
+
+			Convey("Then an error should be returned", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When encoding a message with expiry with PrefixCodec", func() {
+			exp := m
+			exp.ExpiresAt = 1479459567280998
+			data, _ := PrefixCodec{}.Encode(exp)
+			decoded, err := PrefixCodec{}.Decode(data)
+
+			Convey("Then the expiry should be kept", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, exp)
+			})
+		})
+
+		Convey("When encoding a message with headers with PrefixCodec", func() {
+			h := m
+			h.Headers = map[string]string{
+				"content-type": "application/json",
+				"trace.id":     "a:b=c&d",
+			}
+			data, _ := PrefixCodec{}.Encode(h)
+			decoded, err := PrefixCodec{}.Decode(data)
+
+			Convey("Then the headers should be kept", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, h)
+			})
+		})
+
+		Convey("When compressing and decompressing a message", func() {
+			compressed, err := m.compress(CompressionGzip)
+			So(err, ShouldBeNil)
+			data, _ := PrefixCodec{}.Encode(compressed)
+			decoded, _ := PrefixCodec{}.Decode(data)
+			decompressed, err := decoded.decompress()
+
+			Convey("Then the marker should be kept and the same message should be returned", func() {
+				So(err, ShouldBeNil)
+				So(decoded.Compression, ShouldEqual, CompressionGzip)
+				So(decompressed, ShouldResemble, m)
+			})
+		})
+
+		Convey("When encoding a message with ID with PrefixCodec", func() {
+			withID := m
+			withID.ID = "order.1:created"
+			data, _ := PrefixCodec{}.Encode(withID)
+			decoded, err := PrefixCodec{}.Decode(data)
+
+			Convey("Then the ID should be kept", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, withID)
+			})
+		})
+
+		Convey("When encoding messages with nodes with PrefixCodec", func() {
+			n1 := m
+			n1.Node = "0a1b2c3d"
+			n2 := m
+			n2.Node = "ff000000"
+			data1, _ := PrefixCodec{}.Encode(n1)
+			data2, _ := PrefixCodec{}.Encode(n2)
+			decoded, err := PrefixCodec{}.Decode(data1)
+
+			Convey("Then the node should be kept and members should be distinct", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, n1)
+				So(string(data1), ShouldNotEqual, string(data2))
+				So(n1.id(), ShouldNotEqual, n2.id())
+			})
+		})
+
+		Convey("When decoding a body containing separators with PrefixCodec", func() {
+			sep := m
+			sep.Body = []byte("a.b:c")
+			data, _ := PrefixCodec{}.Encode(sep)
+			decoded, err := PrefixCodec{}.Decode(data)
+
+			Convey("Then the body should be kept as is", func() {
+				So(err, ShouldBeNil)
+				So(decoded, ShouldResemble, sep)
+			})
+		})
+
+		Convey("When decoding a too short member with PrefixCodec", func() {
+			_, err := PrefixCodec{}.Decode([]byte("1479459537"))
+
+			Convey("Then error should be occurred", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestJSONCodec(t *testing.T) {
+	Convey("Given a member written by another language", t, func() {
+		member := `{"ts":1479459537280998,"seq":12,"priority":2.5,"deliveries":3,"headers":{"trace":"abc"},"body":"aGVsbG8="}`
+
+		Convey("When decoding it with JSONCodec", func() {
+			m, err := JSONCodec{}.Decode([]byte(member))
+
+			Convey("Then the envelope should be decoded", func() {
+				So(err, ShouldBeNil)
+				So(m.Timestamp, ShouldEqual, 1479459537280998)
+				So(m.Seq, ShouldEqual, 12)
+				So(m.Priority, ShouldEqual, 2.5)
+				So(m.Deliveries, ShouldEqual, 3)
+				So(m.Headers["trace"], ShouldEqual, "abc")
+				So(string(m.Body), ShouldEqual, "hello")
+			})
+		})
+
+		Convey("When encoding a message with JSONCodec", func() {
+			data, err := JSONCodec{}.Encode(Message{
+				Timestamp: 1479459537280998,
+				Node:      "0a1b2c3d",
+				Priority:  1,
+				Body:      []byte("hello"),
+			})
+
+			Convey("Then empty optional fields should be omitted", func() {
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, `{"ts":1479459537280998,"seq":0,"node":"0a1b2c3d","priority":1,"deliveries":0,"body":"aGVsbG8="}`)
+			})
+		})
+	})
+}
+
+func TestConfig_Codec(t *testing.T) {
+	Convey("Given config with JSON codec", t, func() {
+		queueID := "test_codec_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			Codec:     JSONCodec{},
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When putting and getting a message", func() {
+			body := "This is codec data for tests"
+			mq.Put([]byte(body), 1)
+			messages, err := c.Get(1)
+
+			Convey("Then the message should be stored as JSON and decoded", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, body)
+				So(messages[0].GetPriority(), ShouldEqual, 1)
+				So(messages[0].member[0], ShouldEqual, '{')
+			})
+		})
+	})
+}
+
+func TestConfig_Compression(t *testing.T) {
+	Convey("Given config with compression", t, func() {
+		queueID := "test_compression_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:                 queueID,
+			RedisAddr:            redisAddr,
+			RedisDB:              redisDB,
+			Compression:          CompressionGzip,
+			CompressionThreshold: 100,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		plain, _ := NewPriorityMQ(Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		})
+		defer plain.Close()
+
+		Convey("When putting large and small messages into a mixed queue", func() {
+			large := strings.Repeat("This is large compression data for tests. ", 100)
+			small := "small_compression_data"
+			mq.Put([]byte(large), 2)
+			mq.Put([]byte(small), 1)
+			plain.Put([]byte(large), 0)
+
+			res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+			messages, err := plain.GetConsumer().Get(3)
+
+			Convey("Then only large ones should be compressed and all should be decoded", func() {
+				So(len(res.Val()), ShouldEqual, 3)
+				So(len(res.Val()[0]), ShouldBeLessThan, len(large))
+				So(string(getBody(res.Val()[1])), ShouldEqual, small)
+				So(string(getBody(res.Val()[2])), ShouldEqual, large)
+
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[0].GetBody()), ShouldEqual, large)
+				So(string(messages[1].GetBody()), ShouldEqual, small)
+				So(string(messages[2].GetBody()), ShouldEqual, large)
+			})
+		})
+	})
+}
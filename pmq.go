@@ -1,23 +1,464 @@
 package mq
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gopkg.in/redis.v5"
 )
 
 const (
-	// Prefix is unixtime micro
-	prefixLength = 16
+	// Suffix of the sorted set holding claimed but not acked messages scored by the claim time
+	processingSuffix = ":processing"
+	// Suffix of the hash keeping the scores claimed messages had in the queue
+	claimsSuffix = ":claims"
+	// Suffix of the key holding when the queue was aged last in micro seconds
+	agedSuffix = ":aged"
+	// Suffix of the sorted set holding dead letters
+	deadSuffix = ":dead"
+	// Suffix of the sorted set holding messages not ready yet
+	delayedSuffix = ":delayed"
+	// Suffix of the list holding acked messages
+	archiveSuffix = ":archive"
+	// Suffix of the pub/sub channel notified of messages put
+	eventsSuffix = ":events"
+	// Prefix of headers used by the package, which users can't set
+	reservedHeaderPrefix = "pmq-"
+	// Header tagging messages with the producer given to PutFrom
+	producerHeader = "pmq-producer"
+	// Header keeping the priority given at put for Config.PriorityDecay and ReQueueResetPriority.
+	// It is written only when the priority is not Config.DefaultPriority or decay is set.
+	basePriorityHeader = "pmq-priority"
+	// Header keeping unixtime micro of the first put for Config.PriorityDecay since requeues stamp messages again
+	putAtHeader = "pmq-put-at"
+	// GetFair considers this many times the requested number of messages at the head
+	fairWindow = 10
+	// Suffix of the keys marking bodies recently put by PutUnique
+	uniqueSuffix = ":unique:"
+	// Separates the queue key from the names of lanes other than the first one
+	laneSuffix = ":lane:"
+	// Separates the score from the member in delayed messages
+	delayedSeparator = ":"
+
+	// Score bound claiming messages of any priority
+	noScoreLimit = "+inf"
+
+	// Number of members Find asks redis to scan at once
+	scanCount = 100
+
+	// Interval to poll redis while waiting for messages
+	blockingPollInterval = 100 * time.Millisecond
+
+	defaultAgingInterval = time.Second
+	defaultCloseTimeout  = 5 * time.Second
+
+	defaultCompressionThreshold = 1024
+	defaultArchiveSize          = 1000
+
+	// Backoff before pinging redis again after a connection error
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+var (
+	// ErrTimeout is returned when no message is available before timeout
+	ErrTimeout = errors.New("Timed out waiting for messages")
+	// ErrClosed is returned when the message queue is already closed
+	ErrClosed = errors.New("Message queue is closed")
+	// ErrNotConnected is returned when the health check finds redis unreachable
+	ErrNotConnected = errors.New("Redis is not connected")
+	// ErrConnect matches errors returned when NewPriorityMQ fails to connect to redis
+	ErrConnect = errors.New("Failed to connect to redis")
+	// ErrQueueFull is returned when putting messages would exceed Config.MaxLen
+	ErrQueueFull = errors.New("Message queue is full")
+	// ErrClaimLimit is returned when a consumer would hold more than Config.MaxClaimed messages
+	ErrClaimLimit = errors.New("Claimed messages exceed the limit")
+	// ErrMessageTooLarge is returned when putting a message stored in more than Config.MaxMessageBytes
+	ErrMessageTooLarge = errors.New("Message is too large")
+	// ErrDecayWithAging is returned by NewPriorityMQ when both Config.PriorityDecay and AgingRate are set
+	ErrDecayWithAging = errors.New("Priority decay can't be used with aging")
+	// ErrReservedHeader is returned when putting headers prefixed with "pmq-" which the package uses
+	ErrReservedHeader = errors.New("Headers prefixed with pmq- are reserved")
+	// ErrLanes is returned by peeking queues with Config.Lanes since lanes have no single order
+	ErrLanes = errors.New("Lanes have no single order")
+	// ErrInvalidWindow is returned by PutUnique when window is not positive
+	ErrInvalidWindow = errors.New("Window must be positive")
+)
+
+// promoteDelayed moves delayed messages in KEYS[3] which are ready at ARGV[2] into KEYS[1]
+const promoteDelayed = `
+local due = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[2])
+for _, d in ipairs(due) do
+	local sep = string.find(d, ':', 1, true)
+	redis.call('ZADD', KEYS[1], string.sub(d, 1, sep - 1), string.sub(d, sep + 1))
+	redis.call('ZREM', KEYS[3], d)
+end
+`
+
+// claimTaken claims member m taken out of the queue into the processing set scored by the claim time now
+// keeping its score in the hash claims. Taking scripts format it in, or nothing to pop members.
+const claimTaken = `
+	redis.call('ZADD', processing, now, m)
+	redis.call('HSET', claims, m, score)`
+
+// takeTop takes the top ARGV[1] members of KEYS[1] with scores up to ARGV[3]. ARGV[1] <= 0 takes all of them.
+const takeTop = `
+local processing, claims, now = KEYS[2], KEYS[4], ARGV[2]
+local count = tonumber(ARGV[1])
+if count <= 0 then
+	count = -1
+end
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[3], 'WITHSCORES', 'LIMIT', 0, count)
+for i = 1, #members, 2 do
+	local m, score = members[i], members[i + 1]
+	redis.call('ZREM', KEYS[1], m)%s
+end
+return members
+`
+
+// takeNewest is takeTop which takes the newest members first among those with the same score
+const takeNewest = `
+local processing, claims, now = KEYS[2], KEYS[4], ARGV[2]
+local count = tonumber(ARGV[1])
+local taken = {}
+while count <= 0 or #taken < count * 2 do
+	local top = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[3], 'WITHSCORES', 'LIMIT', 0, 1)
+	if #top == 0 then
+		break
+	end
+	local limit = -1
+	if count > 0 then
+		limit = count - #taken / 2
+	end
+	local members = redis.call('ZREVRANGEBYSCORE', KEYS[1], top[2], top[2], 'WITHSCORES', 'LIMIT', 0, limit)
+	for i = 1, #members, 2 do
+		local m, score = members[i], members[i + 1]
+		redis.call('ZREM', KEYS[1], m)%s
+		taken[#taken + 1] = m
+		taken[#taken + 1] = score
+	end
+end
+return taken
+`
+
+// takeMembers takes members ARGV[2:] of KEYS[1] which are still there.
+// Its processing set is KEYS[2], the hash of scores is KEYS[3] and the claim time is ARGV[1].
+const takeMembers = `
+local processing, claims, now = KEYS[2], KEYS[3], ARGV[1]
+local taken = {}
+for i = 2, #ARGV do
+	local m = ARGV[i]
+	local score = redis.call('ZSCORE', KEYS[1], m)
+	if score then
+		redis.call('ZREM', KEYS[1], m)%s
+		taken[#taken + 1] = m
+		taken[#taken + 1] = score
+	end
+end
+return taken
+`
+
+// promoteScript promotes delayed messages like claimScript and returns the number of them
+var promoteScript = redis.NewScript(promoteDelayed + `
+return #due
+`)
+
+var (
+	// claimScript moves the top members of KEYS[1] into the processing set KEYS[2] atomically
+	// so that a member is handed to one consumer at most. Claimed members are scored by the claim time ARGV[2]
+	// and their scores are kept in the hash KEYS[4]. Delayed messages in KEYS[3] which are ready at ARGV[2]
+	// are promoted into KEYS[1] beforehand.
+	claimScript = redis.NewScript(promoteDelayed + fmt.Sprintf(takeTop, claimTaken))
+	// popScript is claimScript which removes members instead of claiming them like ZPOPMIN
+	popScript = redis.NewScript(promoteDelayed + fmt.Sprintf(takeTop, ""))
+	// claimNewestScript is claimScript which takes the newest members first among those with the same score
+	claimNewestScript = redis.NewScript(promoteDelayed + fmt.Sprintf(takeNewest, claimTaken))
+	// popNewestScript is claimNewestScript which removes members instead of claiming them
+	popNewestScript = redis.NewScript(promoteDelayed + fmt.Sprintf(takeNewest, ""))
+	// claimMembersScript claims the given members of KEYS[1] like claimScript skipping those not in KEYS[1] anymore
+	claimMembersScript = redis.NewScript(fmt.Sprintf(takeMembers, claimTaken))
+	// popMembersScript is claimMembersScript which removes members instead of claiming them
+	popMembersScript = redis.NewScript(fmt.Sprintf(takeMembers, ""))
 )
 
+// recoverScript claims members of KEYS[1] claimed up to ARGV[1] again at ARGV[2] and returns them
+// with the scores they had in the queue kept in the hash KEYS[2]. Members claimed by scripts
+// which didn't keep scores return their scores in KEYS[1] instead since they were the scores in the queue.
+var recoverScript = redis.NewScript(`
+local stale = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES')
+local recovered = {}
+for i = 1, #stale, 2 do
+	local score = redis.call('HGET', KEYS[2], stale[i])
+	if not score then
+		score = stale[i + 1]
+	end
+	redis.call('ZADD', KEYS[1], ARGV[2], stale[i])
+	recovered[#recovered + 1] = stale[i]
+	recovered[#recovered + 1] = score
+end
+return recovered
+`)
+
+// unclaimScript moves claimed members ARGV of KEYS[2] back into KEYS[1] with the scores kept in KEYS[3].
+// Members which are not claimed anymore are skipped.
+var unclaimScript = redis.NewScript(`
+for _, m in ipairs(ARGV) do
+	local score = redis.call('HGET', KEYS[3], m)
+	if score and redis.call('ZREM', KEYS[2], m) == 1 then
+		redis.call('ZADD', KEYS[1], score, m)
+	end
+	redis.call('HDEL', KEYS[3], m)
+end
+return #ARGV
+`)
+
+// buryScript moves claimed members ARGV[2i] of KEYS[2] into KEYS[1] with scores ARGV[2i-1] and forgets their claims in KEYS[3]
+var buryScript = redis.NewScript(`
+for i = 1, #ARGV, 2 do
+	redis.call('ZADD', KEYS[1], ARGV[i], ARGV[i + 1])
+	redis.call('ZREM', KEYS[2], ARGV[i + 1])
+	redis.call('HDEL', KEYS[3], ARGV[i + 1])
+end
+return #ARGV / 2
+`)
+
+// quarantineScript moves all members of KEYS[2:ARGV[1]+1] and delayed ones in the rest of KEYS into KEYS[1]
+// keeping their scores. It returns the number of moved members.
+var quarantineScript = redis.NewScript(`
+local queues = tonumber(ARGV[1])
+local moved = 0
+for k = 2, #KEYS do
+	local members = redis.call('ZRANGE', KEYS[k], 0, -1, 'WITHSCORES')
+	for i = 1, #members, 2 do
+		if k <= queues + 1 then
+			redis.call('ZADD', KEYS[1], members[i + 1], members[i])
+		else
+			local sep = string.find(members[i], ':', 1, true)
+			redis.call('ZADD', KEYS[1], string.sub(members[i], 1, sep - 1), string.sub(members[i], sep + 1))
+		end
+		moved = moved + 1
+	end
+	redis.call('DEL', KEYS[k])
+end
+return moved
+`)
+
+// memberExistsScript returns 1 if ARGV[i] is a member of KEYS[i] for any i and 0 otherwise
+var memberExistsScript = redis.NewScript(`
+for i, k in ipairs(KEYS) do
+	if redis.call('ZSCORE', k, ARGV[i]) then
+		return 1
+	end
+end
+return 0
+`)
+
+// agingScript adds ARGV[1] per second elapsed since the time in KEYS[2] to the scores of all members of KEYS[1]
+// and sets the time to ARGV[2], so that brokers aging the same queue don't add it twice
+var agingScript = redis.NewScript(`
+local last = tonumber(redis.call('GET', KEYS[2]))
+local now = tonumber(ARGV[2])
+if last and now <= last then
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[2])
+if not last then
+	return 0
+end
+local incr = tonumber(ARGV[1]) * (now - last) / 1000000
+local members = redis.call('ZRANGE', KEYS[1], 0, -1)
+for _, m in ipairs(members) do
+	redis.call('ZINCRBY', KEYS[1], incr, m)
+end
+return #members
+`)
+
+// boundedAddScript adds members to lanes KEYS only when none of their lengths exceeds ARGV[1] after that.
+// ARGV[2:] are triples of the index of the lane in KEYS, score and member.
+// It returns 0 without adding any of them when a lane is full.
+var boundedAddScript = redis.NewScript(`
+local counts = {}
+for i = 2, #ARGV, 3 do
+	local k = tonumber(ARGV[i])
+	counts[k] = (counts[k] or 0) + 1
+end
+for k, count in pairs(counts) do
+	if redis.call('ZCARD', KEYS[k]) + count > tonumber(ARGV[1]) then
+		return 0
+	end
+end
+for i = 2, #ARGV, 3 do
+	redis.call('ZADD', KEYS[tonumber(ARGV[i])], ARGV[i + 1], ARGV[i + 2])
+end
+return 1
+`)
+
+// updateScript sets the score of member ARGV[2] to ARGV[1] in the lane of KEYS holding it.
+// It returns 0 when no lane holds it.
+var updateScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if redis.call('ZSCORE', key, ARGV[2]) then
+		redis.call('ZADD', key, ARGV[1], ARGV[2])
+		return 1
+	end
+end
+return 0
+`)
+
+// addUnlessPresentScript adds members to KEYS[1] unless their originals are in it.
+// ARGV are triples of original member, score and member. It returns the number of added members.
+var addUnlessPresentScript = redis.NewScript(`
+local added = 0
+for i = 1, #ARGV, 3 do
+	if not redis.call('ZSCORE', KEYS[1], ARGV[i]) then
+		redis.call('ZADD', KEYS[1], ARGV[i + 1], ARGV[i + 2])
+		added = added + 1
+	end
+end
+return added
+`)
+
+// DeliveryMode is the guarantee of delivery chosen by Config.DeliveryMode
+type DeliveryMode int
+
+const (
+	// AtLeastOnce claims messages on Get and removes them on Ack.
+	// Messages claimed by a consumer which crashes stay in the processing set and are not lost,
+	// and they are delivered again once MessageQueue.Recover or Config.VisibilityTimeout queues them again.
+	AtLeastOnce DeliveryMode = iota
+	// AtMostOnce pops messages atomically on Get, so Ack, ReQueue and the like do nothing for them.
+	// Messages popped by a consumer which crashes are lost but never delivered twice,
+	// since they are never claimed. They are not archived by Config.ArchiveAcked as they are never acked.
+	AtMostOnce
+)
+
+// Logger reports errors occurring in background. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// redisCmdable is the part of redis clients used by the broker.
+// *redis.Client and *redis.ClusterClient satisfy it. It is not meant for fakes of the whole broker:
+// fakes can stand in for plain commands like putting in tests, but claiming and acking run Lua scripts
+// and pipelines, so consumers need a server running them like redis or miniredis.
+type redisCmdable interface {
+	Ping() *redis.StatusCmd
+	Del(keys ...string) *redis.IntCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZAddXX(key string, members ...redis.Z) *redis.IntCmd
+	ZCard(key string) *redis.IntCmd
+	ZRange(key string, start, stop int64) *redis.StringSliceCmd
+	ZRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZRem(key string, members ...interface{}) *redis.IntCmd
+	ZScan(key string, cursor uint64, match string, count int64) *redis.ScanCmd
+	Process(cmd redis.Cmder) error
+	LRange(key string, start, stop int64) *redis.StringSliceCmd
+	Publish(channel, message string) *redis.IntCmd
+	Pipelined(fn func(*redis.Pipeline) error) ([]redis.Cmder, error)
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(scripts ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
+	Close() error
+}
+
+// subscriber is implemented by redis clients supporting pub/sub
+type subscriber interface {
+	Subscribe(channels ...string) (*redis.PubSub, error)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
 type broker struct {
+	// 64-bit atomic fields come first to keep them aligned on 32-bit platforms
+	inFlight int64
+	stats    Stats
+	// stampMu guards the last timestamp and sequence given to a message
+	stampMu       sync.Mutex
+	lastTimestamp int64
+	seq           uint32
+	// node tells members stamped by the broker from those of other processes
+	node         string
 	id           string
-	redisClient  *redis.Client
+	processingID string
+	claimsID     string
+	deadID       string
+	delayedID    string
+	archiveID    string
+	eventsID     string
+	// archiveSize is the capacity of the archive. Zero disables it.
+	archiveSize int64
+	cfg         Config
+	codec       Codec
+	compression Compression
+	// compressionThreshold is the minimum body size to compress
+	compressionThreshold int
+	logger               Logger
+	maxRetries           int
+	closeTimeout         time.Duration
+	maxDeliveries        int
+	maxClaimed           int
+	maxGetBatch          int64
+	maxLen               int64
+	maxMessageBytes      int
+	lowerIsHigher        bool
+	deliveryMode         DeliveryMode
+	// now is the clock stamping messages and scheduling delays and TTLs
+	now func() time.Time
+	// Fields below are shared by brokers of queues created by MessageQueue.Queue
+	redisClient  redisCmdable
 	consumerAckC chan *consumerAck
+	quit         chan struct{}
 	done         chan struct{}
+	closeOnce    *sync.Once
+	// workers are background loops other than the ack listener
+	workers *sync.WaitGroup
+	// connected is 1 while the health check reaches redis. Nil means always connected.
+	connected *int32
+	// ownsClient is set when the client is created by the broker to be closed with it
+	ownsClient bool
+	// lanes are drawn by weight when Config.Lanes is set. The first one is keyed by id.
+	lanes []lane
+	// laneMu guards current weights of lanes
+	laneMu sync.Mutex
+}
+
+// lane is a sorted set of the queue drawn in proportion to weight
+type lane struct {
+	name      string
+	weight    int
+	id        string
+	delayedID string
+	// current is the running weight of smooth weighted round robin
+	current int
+}
+
+// LaneConfig is a lane of the queue named Name which is drawn in proportion to Weight
+type LaneConfig struct {
+	Name string
+	// Weight is the share of the lane in each Get. Zero or negative means 1.
+	Weight int
 }
 
 // MessageQueue is message queue client
@@ -29,38 +470,267 @@ type Config struct {
 	Name      string
 	RedisAddr string
 	RedisDB   int
+	// ClusterAddrs connects to a redis cluster instead of RedisAddr when not empty.
+	// RedisDB and SentinelAddrs are ignored in cluster mode.
+	// Keys of a queue are hash tagged to stay in one slot, and a KeyPrefix with its own
+	// hash tag like "{jobs}" places all queues sharing it in one slot.
+	ClusterAddrs []string
+	// SentinelAddrs connects to the master named MasterName via sentinels instead of RedisAddr when not empty
+	SentinelAddrs []string
+	MasterName    string
+	// RedisPassword is sent with AUTH when not empty
+	RedisPassword string
+	// TLSConfig enables TLS for the connection to RedisAddr when not nil
+	TLSConfig *tls.Config
+	// KeyPrefix namespaces the redis keys as "<KeyPrefix>:<Name>" when not empty
+	KeyPrefix string
+	// Codec encodes messages into members. PrefixCodec is used when nil.
+	Codec Codec
+	// Compression compresses bodies of CompressionThreshold bytes or more when they are put.
+	// Messages are decompressed by the marker stored with them regardless of this setting.
+	Compression Compression
+	// CompressionThreshold is the minimum body size to compress. Default is 1024 bytes.
+	CompressionThreshold int
+
+	// Connection pool settings passed to redis.Options.
+	// Zero values fall through to redis defaults.
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxRetries is how many times an operation failed with a connection error
+	// is retried after redis answers ping again. Zero disables retries.
+	// Note that a retried Get may lose messages claimed by a request whose response was lost.
+	MaxRetries int
+
+	// Logger reports errors occurring in background. Nothing is logged when nil.
+	Logger Logger
+	// AckWorkers is the number of goroutines removing acked messages from redis concurrently.
+	// Default is 1.
+	AckWorkers int
+	// HealthCheckInterval is how often redis is pinged in background.
+	// Operations return ErrNotConnected while the last ping failed. Zero disables it.
+	HealthCheckInterval time.Duration
+	// OnConnect is called whenever a new connection to redis is established.
+	// It is not called with ClusterAddrs or SentinelAddrs.
+	OnConnect func()
+	// OnDisconnect is called with the error of the health check when it finds redis unreachable.
+	// It requires HealthCheckInterval.
+	OnDisconnect func(error)
+	// CloseTimeout is how long Close waits for background loops stuck on redis
+	// before closing the connection under them. Default is 5 seconds.
+	CloseTimeout time.Duration
+
+	// VisibilityTimeout queues messages claimed longer than it again in background like MessageQueue.Recover,
+	// checking every half of it. Messages held longer by live consumers are delivered twice. Zero disables it.
+	VisibilityTimeout time.Duration
+
+	// AgingRate is the priority added per second to waiting messages
+	// so that low priority ones are not starved. Zero disables aging.
+	// Queues sharing a name age their messages once however many of them set it.
+	// It is subtracted instead when LowerIsHigher is set.
+	AgingRate float64
+	// AgingInterval is how often waiting messages are aged or decayed. Default is 1 second.
+	AgingInterval time.Duration
+	// PriorityDecay returns the priority of a waiting message put with base priority age ago
+	// so that stale messages sink toward the tail. Waiting messages are rescored every AgingInterval,
+	// which decodes all of them. Messages put by the first release are not rescored. It can't be used with AgingRate.
+	PriorityDecay func(age time.Duration, base float64) float64
+	// MaxLen is the number of messages the queue can hold. Put returns ErrQueueFull beyond it.
+	// Messages queued again and delayed ones are not limited. Zero means unlimited.
+	MaxLen int64
+	// MaxMessageBytes is the size limit of a stored member including its prefix after compression.
+	// Put returns ErrMessageTooLarge beyond it. Zero means unlimited.
+	MaxMessageBytes int
+	// MaxClaimed is the number of messages a consumer can hold without acking.
+	// Get fetching more than it returns ErrClaimLimit, and Get(0) claims as many as the consumer can still hold.
+	// Zero means unlimited.
+	MaxClaimed int
+	// MaxGetBatch caps the number of messages a single Get claims, including Get(0) which claims all.
+	// Get asking for more returns at most MaxGetBatch messages without an error. Zero means unlimited.
+	MaxGetBatch int64
+	// PublishEvents publishes on the channel "<key>:events" whenever messages are put or queued again
+	// so that consumers waiting by Consumer.Notifications are woken up.
+	PublishEvents bool
+	// ArchiveAcked keeps the last ArchiveSize acked messages to be read by Archive.
+	ArchiveAcked bool
+	// ArchiveSize is the number of acked messages archived. Default is 1000.
+	ArchiveSize int64
+	// DefaultPriority is the priority of messages put by PutDefault. Default is 0.
+	DefaultPriority float64
+	// LowerIsHigher delivers messages with lower priority first like nice values.
+	// Queues sharing a key must agree on it.
+	LowerIsHigher bool
+	// DeliveryMode chooses between claiming messages until Ack and removing them on Get.
+	// Default is AtLeastOnce.
+	DeliveryMode DeliveryMode
+	// MaxDeliveries moves messages delivered this many times to the dead letter queue
+	// instead of queueing them again. Zero means unlimited.
+	MaxDeliveries int
+	// Lanes splits the queue into sorted sets which Get draws from in proportion to their weights
+	// so that no lane is starved by another. Priorities order messages within a lane.
+	// The first lane is the queue itself. Peek, PeekTail and PeekRange return ErrLanes since lanes have no single order.
+	// MaxLen bounds each lane, and a batch is put only when none of its lanes is full.
+	Lanes []LaneConfig
+	// LaneSelector returns the name of the lane a message is put into.
+	// Messages go to the first lane when it is nil or returns an unknown name.
+	// It must return the same lane for the same body and priority to queue messages again into their lane.
+	LaneSelector func(body []byte, priority float64) string
+	// Now is the clock stamping messages and scheduling delays and TTLs. Default is time.Now.
+	// Clients sharing a queue should agree on it since delayed messages are promoted by the clock of Get.
+	Now func() time.Time
+}
+
+// key returns the redis key of the queue.
+// It is hash tagged in cluster mode unless it has a hash tag already.
+func (cfg Config) key() string {
+	key := cfg.Name
+	if cfg.KeyPrefix != "" {
+		key = cfg.KeyPrefix + ":" + cfg.Name
+	}
+
+	if len(cfg.ClusterAddrs) != 0 && !hasHashTag(key) {
+		key = "{" + key + "}"
+	}
+
+	return key
+}
+
+// hasHashTag reports whether redis cluster hashes only a part of key
+func hasHashTag(key string) bool {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return false
+	}
+	end := strings.Index(key[start+1:], "}")
+
+	return end > 0
+}
+
+// Reader reads messages of the queue without claiming or removing any of them
+type Reader struct {
+	broker *broker
 }
 
 type Consumer struct {
 	broker           *broker
 	notAckedMessages PrioritizedMessages
+	// lastBatch is the batch fetched last which is returned again until any message is acked
+	lastBatch PrioritizedMessages
+	// closed is set by Close
+	closed bool
+	// batches are claimed by GetBatch and keyed by the IDs numbered with batchSeq
+	batches  map[string]PrioritizedMessages
+	batchSeq int64
+}
+
+// MessageIterator iterates messages claimed by Consumer.GetIterator one by one
+type MessageIterator struct {
+	// AckConsumed acks each message when Next moves past it
+	AckConsumed bool
+
+	consumer *Consumer
+	messages PrioritizedMessages
+	// consumed is the number of messages returned by Next and acked is its prefix already acked
+	consumed int
+	acked    int
+	err      error
 }
 
 type consumerAck struct {
-	members []string
+	// key is the processing set holding members and claimsKey is the hash keeping their scores
+	key       string
+	claimsKey string
+	members   []string
+	// requeue is set when members are removed to be queued again
+	requeue bool
+	// archived are pushed into archiveKey capped at archiveSize when not empty
+	archived    []interface{}
+	archiveKey  string
+	archiveSize int64
+	// failed is set to members which failed to be removed before an error is sent to errC,
+	// and missing to members which were not in the processing set
+	failed  []string
+	missing []string
 	errC    chan error
 }
 
+// AckError is returned when some of messages failed to be acked.
+// Messages other than Failed are acked.
+type AckError struct {
+	Failed PrioritizedMessages
+	Err    error
+}
+
+func (e *AckError) Error() string {
+	return fmt.Sprintf("Failed to ack %d messages: %v", len(e.Failed), e.Err)
+}
+
+// ConnectError is returned when NewPriorityMQ fails to connect to redis.
+// errors.Is(err, ErrConnect) holds for it and Unwrap returns the cause.
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return ErrConnect.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the cause
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrConnect
+func (e *ConnectError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+// QueueInfo is the usage of redis by waiting messages of a queue
+type QueueInfo struct {
+	// Len is the number of waiting messages including all lanes
+	Len int64
+	// MemoryUsage is the bytes used by the sorted sets of waiting messages
+	// or -1 if the server doesn't support MEMORY USAGE
+	MemoryUsage int64
+	// Oldest and Newest are when the oldest and the newest waiting messages were put.
+	// They are zero when the queue is empty.
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Stats is the activity of a message queue since it was created
+type Stats struct {
+	Put      int64
+	Gotten   int64
+	Acked    int64
+	ReQueued int64
+	// Len is the number of waiting messages or -1 if it can't be fetched
+	Len int64
+}
+
 // PrioritizedMessage is message data with priority
 type PrioritizedMessage struct {
 	member   string
+	message  Message
 	priority float64
 }
 
 type PrioritizedMessages []PrioritizedMessage
 
-func getMember(body []byte) string {
-	// Added prefix to let redis sort them lexicographically
-	prefix := strconv.FormatInt(time.Now().UnixNano()/1000, 10)
-	return prefix + string(body)
-}
+func (pm PrioritizedMessages) getMembers() []string {
+	members := make([]string, 0, len(pm))
+	for i := range pm {
+		members = append(members, pm[i].member)
+	}
 
-func getBody(member string) []byte {
-	return []byte(member[prefixLength:])
+	return members
 }
 
-func (pm PrioritizedMessages) getMembers() []string {
-	members := make([]string, 0, len(pm))
+// getMemberValues returns members to pass to variadic redis commands
+func (pm PrioritizedMessages) getMemberValues() []interface{} {
+	members := make([]interface{}, 0, len(pm))
 	for i := range pm {
 		members = append(members, pm[i].member)
 	}
@@ -68,22 +738,41 @@ func (pm PrioritizedMessages) getMembers() []string {
 	return members
 }
 
-func (pm PrioritizedMessages) refreshMembers() {
+func (pm PrioritizedMessages) contains(member string) bool {
 	for i := range pm {
-		pm[i].member = getMember(getBody(pm[i].member))
+		if pm[i].member == member {
+			return true
+		}
 	}
+
+	return false
 }
 
-func (pm *PrioritizedMessage) convertToZ() redis.Z {
-	return redis.Z{
-		Member: pm.member,
-		Score:  -pm.priority,
+func containsString(ss []string, s string) bool {
+	for i := range ss {
+		if ss[i] == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exclude returns a new slice without the members of ms
+func (pm PrioritizedMessages) exclude(ms PrioritizedMessages) PrioritizedMessages {
+	var rest PrioritizedMessages
+	for i := range pm {
+		if !ms.contains(pm[i].member) {
+			rest = append(rest, pm[i])
+		}
 	}
+
+	return rest
 }
 
 // GetBody gets message body
 func (pm *PrioritizedMessage) GetBody() []byte {
-	return getBody(pm.member)
+	return pm.message.Body
 }
 
 // GetPriority gets messages priority
@@ -91,180 +780,2952 @@ func (pm *PrioritizedMessage) GetPriority() float64 {
 	return pm.priority
 }
 
+// GetLevel gets the priority as an integer level put by PutInt.
+// Priorities which are not integers like aged ones are rounded.
+func (pm *PrioritizedMessage) GetLevel() int {
+	return int(math.Round(pm.priority))
+}
+
+// ID returns the ID given by PutWithID or derived from the first stamp and the body.
+// It is stable across ReQueue.
+func (pm *PrioritizedMessage) ID() string {
+	return pm.message.id()
+}
+
+// Member returns the sorted set member of the message to be acked by MessageQueue.AckByMember.
+// It changes when the message is queued again.
+func (pm *PrioritizedMessage) Member() string {
+	return pm.member
+}
+
+// DeliveryCount returns how many times the message has been gotten including this time.
+// It survives ReQueue since deliveries are stored in the member.
+func (pm *PrioritizedMessage) DeliveryCount() int {
+	return pm.message.Deliveries + 1
+}
+
+// Header returns the value of the header named key.
+// Headers prefixed with "pmq-" are used by the package and not returned.
+func (pm *PrioritizedMessage) Header(key string) (string, bool) {
+	if strings.HasPrefix(key, reservedHeaderPrefix) {
+		return "", false
+	}
+
+	v, ok := pm.message.Headers[key]
+	return v, ok
+}
+
+// EnqueuedAt returns when the message was put or queued again last.
+// It returns the zero time when the message has no timestamp.
+func (pm *PrioritizedMessage) EnqueuedAt() time.Time {
+	if pm.message.Timestamp == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, pm.message.Timestamp*1000)
+}
+
+// Producer returns the producer given to PutFrom or an empty string
+func (pm *PrioritizedMessage) Producer() string {
+	return pm.message.Headers[producerHeader]
+}
+
 // AddPriority adds additional priority
 func (pm *PrioritizedMessage) AddPriority(p float64) {
 	pm.priority += p
 }
 
-func (b *broker) startAckListner() {
+// startAckListner starts workers listening acks and closes done after all of them stop
+func (b *broker) startAckListner(workers int) {
+	var listeners sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			b.listenAcks()
+		}()
+	}
+
 	go func() {
-		defer close(b.done)
+		listeners.Wait()
+		close(b.done)
+	}()
+}
 
-		for ca := range b.consumerAckC {
-			if ca.errC == nil {
-				ca.errC = make(chan error, 1)
-			}
+func (b *broker) listenAcks() {
+	for {
+		var ca *consumerAck
+		select {
+		case ca = <-b.consumerAckC:
+		case <-b.quit:
+			return
+		}
 
-			var err error
+		if ca.errC == nil {
+			ca.errC = make(chan error, 1)
+		}
+
+		// Remove all members in one round trip checking each result
+		var archiveCmd *redis.IntCmd
+		cmds := make([]*redis.IntCmd, len(ca.members))
+		_, pipeErr := b.redisClient.Pipelined(func(pipe *redis.Pipeline) error {
+			if len(ca.archived) != 0 {
+				archiveCmd = pipe.LPush(ca.archiveKey, ca.archived...)
+				pipe.LTrim(ca.archiveKey, 0, ca.archiveSize-1)
+			}
 			for i := range ca.members {
-				ic := b.redisClient.ZRem(b.id, ca.members[i])
-				if _err := ic.Err(); _err != nil {
-					err = _err
-					break
-				}
+				cmds[i] = pipe.ZRem(ca.key, ca.members[i])
 			}
+			if ca.claimsKey != "" {
+				pipe.HDel(ca.claimsKey, ca.members...)
+			}
+			return nil
+		})
 
-			ca.errC <- err
-			close(ca.errC)
+		var err error
+		for i := range cmds {
+			if cmds[i] == nil || cmds[i].Err() != nil {
+				ca.failed = append(ca.failed, ca.members[i])
+				if err == nil {
+					err = pipeErr
+				}
+			} else if cmds[i].Val() == 0 {
+				ca.missing = append(ca.missing, ca.members[i])
+			}
+		}
+		if err != nil {
+			b.logger.Printf("mq: failed to ack %d members of %s: %v", len(ca.failed), ca.key, err)
+		}
+		if archiveCmd != nil && archiveCmd.Err() != nil {
+			b.logger.Printf("mq: failed to archive %d members of %s: %v", len(ca.archived), ca.archiveKey, archiveCmd.Err())
 		}
-	}()
-}
 
-func (b *broker) put(messages ...PrioritizedMessage) error {
+		ca.errC <- err
+		close(ca.errC)
+	}
+}
 
-	var data []redis.Z
-	for i := range messages {
-		data = append(data, messages[i].convertToZ())
+// sendAck passes ca to the ack listener unless the broker is closed
+func (b *broker) sendAck(ca *consumerAck) error {
+	select {
+	case b.consumerAckC <- ca:
+		return nil
+	case <-b.quit:
+		return ErrClosed
 	}
+}
 
-	res := b.redisClient.ZAdd(b.id, data...)
-	if err := res.Err(); err != nil {
+// waitAck waits for the result of ca sent by sendAck.
+// It returns ErrClosed when the listeners stopped before handling ca.
+func (b *broker) waitAck(ca *consumerAck) error {
+	select {
+	case err := <-ca.errC:
 		return err
+	case <-b.done:
+		select {
+		case err := <-ca.errC:
+			return err
+		default:
+			return ErrClosed
+		}
 	}
-
-	return nil
 }
 
-func (b *broker) get(num int64) (messages PrioritizedMessages, err error) {
-	res := b.redisClient.ZRangeWithScores(b.id, 0, num-1)
-	if _err := res.Err(); _err != nil {
-		err = _err
-		return
+func (b *broker) isClosed() bool {
+	select {
+	case <-b.quit:
+		return true
+	default:
+		return false
 	}
+}
 
-	if len(res.Val()) == 0 {
-		return
-	}
+// close stops the ack listener and the redis client only once.
+// The client is closed after closeTimeout even if background loops are still waiting for redis.
+func (b *broker) close() {
+	b.closeOnce.Do(func() {
+		close(b.quit)
 
-	for i := range res.Val() {
-		member, ok := res.Val()[i].Member.(string)
-		if !ok {
-			err = errors.New("Member has invalid type data")
-			return
+		stopped := make(chan struct{})
+		go func() {
+			<-b.done
+			b.workers.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(b.closeTimeout):
+			b.logger.Printf("mq: timed out waiting for background loops of %s to stop", b.id)
 		}
-		messages = append(messages, PrioritizedMessage{
-			member:   member,
-			priority: -res.Val()[i].Score,
-		})
-	}
 
-	return
+		if b.ownsClient {
+			b.redisClient.Close()
+		}
+	})
 }
 
-// NewPriorityMQ creates a new message queue
-func NewPriorityMQ(cfg Config) (*MessageQueue, error) {
-	rc := redis.NewClient(&redis.Options{
-		Addr: cfg.RedisAddr,
-		DB:   cfg.RedisDB,
-	})
+// startAging boosts priorities of waiting messages in all lanes by rate per second every interval.
+// The time each lane is aged last is kept in redis so that the rate holds however many brokers age the queue.
+func (b *broker) startAging(rate float64, interval time.Duration) {
+	// Lower scores come first in either ordering
+	incr := -rate
 
-	// Make redis connect sure
-	res := rc.Ping()
-	if err := res.Err(); err != nil {
-		return nil, err
-	}
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
 
-	broker := &broker{
-		id:           cfg.Name,
-		redisClient:  rc,
-		consumerAckC: make(chan *consumerAck),
-		done:         make(chan struct{}),
-	}
-	broker.startAckListner()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-	return &MessageQueue{
-		broker: broker,
-	}, nil
+		for {
+			select {
+			case <-ticker.C:
+				for _, id := range b.laneIDs() {
+					err := agingScript.Run(b.redisClient, []string{id, id + agedSuffix}, incr, b.now().UnixNano()/1000).Err()
+					if err != nil {
+						b.logger.Printf("mq: failed to age messages of %s: %v", id, err)
+					}
+				}
+			case <-b.quit:
+				return
+			}
+		}
+	}()
 }
 
-// Put puts message and priority
-func (mq *MessageQueue) Put(body []byte, priority float64) error {
-	return mq.broker.put(PrioritizedMessage{member: getMember(body), priority: priority})
+// startRecovery queues messages claimed longer than timeout again every half of it
+func (b *broker) startRecovery(timeout time.Duration) {
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
+
+		interval := timeout / 2
+		if interval <= 0 {
+			interval = timeout
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := b.recover(context.Background(), timeout); err != nil {
+					b.logger.Printf("mq: failed to recover claimed messages of %s: %v", b.id, err)
+				}
+			case <-b.quit:
+				return
+			}
+		}
+	}()
 }
 
-// Close close message queue
-func (mq *MessageQueue) Close() {
-	close(mq.broker.consumerAckC)
-	<-mq.broker.done
+// startDecay rescores waiting messages by Config.PriorityDecay every interval
+func (b *broker) startDecay(interval time.Duration) {
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := b.decay(context.Background()); err != nil {
+					b.logger.Printf("mq: failed to decay messages of %s: %v", b.id, err)
+				}
+			case <-b.quit:
+				return
+			}
+		}
+	}()
 }
 
-func (mq *MessageQueue) GetConsumer() *Consumer {
-	c := &Consumer{
-		broker: mq.broker,
+// decay rescores waiting messages in all lanes like decayLane
+func (b *broker) decay(ctx context.Context) error {
+	for _, id := range b.laneIDs() {
+		if err := b.decayLane(ctx, id); err != nil {
+			return err
+		}
 	}
 
-	return c
+	return nil
 }
 
-// Get gets bodies and priorities
-func (c *Consumer) Get(num int64) (messages PrioritizedMessages, err error) {
-	if len(c.notAckedMessages) != 0 {
-		messages = c.notAckedMessages
-		return
+// decayLane rescores waiting messages of the lane id put with their base priorities by the age since the first put,
+// so that requeues don't compound it. Messages claimed meanwhile are not added back.
+func (b *broker) decayLane(ctx context.Context, id string) error {
+	var zs []redis.Z
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		var err error
+		zs, err = rc.ZRangeWithScores(id, 0, -1).Result()
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	messages, err = c.broker.get(num)
-	if err != nil {
-		return
+	now := b.now()
+	var decayed []redis.Z
+	for i := range zs {
+		member, ok := zs[i].Member.(string)
+		if !ok {
+			continue
+		}
+		pm, err := b.decode(member, 0)
+		if err != nil {
+			continue
+		}
+		base, err := strconv.ParseFloat(pm.message.Headers[basePriorityHeader], 64)
+		if err != nil {
+			continue
+		}
+		putAt := pm.EnqueuedAt()
+		if ts, err := strconv.ParseInt(pm.message.Headers[putAtHeader], 10, 64); err == nil {
+			putAt = time.Unix(0, ts*1000)
+		}
+		pm.priority = b.cfg.PriorityDecay(now.Sub(putAt), base)
+		decayed = append(decayed, b.convertToZ(pm))
+	}
+	if len(decayed) == 0 {
+		return nil
 	}
 
-	c.notAckedMessages = messages
+	return b.withContext(ctx, func(rc redisCmdable) error {
+		return rc.ZAddXX(id, decayed...).Err()
+	})
+}
 
-	return
+// startHealthCheck pings redis every interval to keep the connection state
+func (b *broker) startHealthCheck(interval time.Duration) {
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-b.quit:
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := b.do(ctx, func(rc redisCmdable) error {
+				return rc.Ping().Err()
+			})
+			cancel()
+			if err == ErrClosed {
+				return
+			}
+
+			if err != nil {
+				if atomic.SwapInt32(b.connected, 0) == 1 {
+					b.logger.Printf("mq: lost connection to redis for %s: %v", b.id, err)
+					if b.cfg.OnDisconnect != nil {
+						b.cfg.OnDisconnect(err)
+					}
+				}
+			} else if atomic.SwapInt32(b.connected, 1) == 0 {
+				b.logger.Printf("mq: reconnected to redis for %s", b.id)
+			}
+		}
+	}()
 }
 
-func (c *Consumer) Ack() error {
-	if len(c.notAckedMessages) == 0 {
-		return nil
-	}
+func (b *broker) isConnected() bool {
+	return b.connected == nil || atomic.LoadInt32(b.connected) == 1
+}
 
-	errC := make(chan error)
-	c.broker.consumerAckC <- &consumerAck{
-		members: c.notAckedMessages.getMembers(),
-		errC:    errC,
+// withContext runs fn with a client bound to ctx retrying on connection errors.
+// It returns ErrNotConnected without running fn while the health check fails.
+func (b *broker) withContext(ctx context.Context, fn func(rc redisCmdable) error) error {
+	if !b.isClosed() && !b.isConnected() {
+		return ErrNotConnected
 	}
 
-	for err := range errC {
+	err := b.do(ctx, fn)
+	for attempt := 0; attempt < b.maxRetries && isConnError(err); attempt++ {
+		b.logger.Printf("mq: lost connection to redis for %s: %v", b.id, err)
+
+		err = b.reconnect(ctx, attempt)
 		if err != nil {
-			return err
+			continue
 		}
+		err = b.do(ctx, fn)
 	}
 
-	c.notAckedMessages = nil
-
-	return nil
+	return err
 }
 
-// ReQueue queue members again
-func (c *Consumer) ReQueue() error {
-	if len(c.notAckedMessages) == 0 {
-		return nil
+// reconnect waits for jittered backoff and pings redis to make the connection sure.
+// Jitter keeps clients which lost the connection at once from retrying in lockstep.
+func (b *broker) reconnect(ctx context.Context, attempt int) error {
+	backoff := retryBackoff << uint(attempt)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
 	}
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
 
-	notAckedMessages := c.notAckedMessages
-
-	// Ack at first
-	err := c.Ack()
-	if err != nil {
-		return err
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.quit:
+		return ErrClosed
 	}
 
-	notAckedMessages.refreshMembers()
+	return b.do(ctx, func(rc redisCmdable) error {
+		return rc.Ping().Err()
+	})
+}
 
-	err = c.broker.put(notAckedMessages...)
-	if err != nil {
-		return err
+// isConnError reports whether err is caused by a broken connection
+func isConnError(err error) bool {
+	if err == nil {
+		return false
 	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// do runs fn once with a client bound to ctx unless ctx is done already.
+// fn runs to the end even if ctx is done meanwhile since redis.v5 doesn't abort commands sent,
+// so that the results of commands which took effect, e.g. claimed messages, are never dropped.
+func (b *broker) do(ctx context.Context, fn func(rc redisCmdable) error) error {
+	if b.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rc := b.redisClient
+	if c, ok := rc.(*redis.Client); ok {
+		rc = c.WithContext(ctx)
+	}
+
+	return fn(rc)
+}
+
+func (b *broker) put(ctx context.Context, messages ...PrioritizedMessage) error {
+	err := b.checkSize(messages)
+	if err != nil {
+		return err
+	}
+
+	if b.maxLen > 0 {
+		err = b.addBounded(ctx, messages...)
+	} else {
+		err = b.addToLanes(ctx, messages...)
+	}
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.Put, int64(len(messages)))
+	b.publishEvent(ctx)
+	return nil
+}
+
+// publishEvent notifies consumers of new messages when Config.PublishEvents is set.
+// Messages are put even if it fails.
+func (b *broker) publishEvent(ctx context.Context) {
+	if !b.cfg.PublishEvents {
+		return
+	}
+
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		return rc.Publish(b.eventsID, "put").Err()
+	})
+	if err != nil {
+		b.logger.Printf("mq: failed to publish an event of %s: %v", b.id, err)
+	}
+}
+
+func (b *broker) add(ctx context.Context, key string, messages ...PrioritizedMessage) error {
+
+	var data []redis.Z
+	for i := range messages {
+		data = append(data, b.convertToZ(messages[i]))
+	}
+
+	return b.withContext(ctx, func(rc redisCmdable) error {
+		return rc.ZAdd(key, data...).Err()
+	})
+}
+
+// checkSize returns ErrMessageTooLarge when any member of messages exceeds maxMessageBytes
+func (b *broker) checkSize(messages PrioritizedMessages) error {
+	if b.maxMessageBytes <= 0 {
+		return nil
+	}
+
+	for i := range messages {
+		if len(messages[i].member) > b.maxMessageBytes {
+			return ErrMessageTooLarge
+		}
+	}
+
+	return nil
+}
+
+// addToLanes adds messages to the lanes they are routed to
+func (b *broker) addToLanes(ctx context.Context, messages ...PrioritizedMessage) error {
+	ids, groups := b.routeLanes(messages)
+	for i := range ids {
+		if err := b.add(ctx, ids[i], groups[i]...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addBounded adds messages to the queue atomically unless it exceeds maxLen.
+// Each lane is bounded separately, and none of messages is added when any of their lanes is full.
+func (b *broker) addBounded(ctx context.Context, messages ...PrioritizedMessage) error {
+	ids, groups := b.routeLanes(messages)
+	args := []interface{}{b.maxLen}
+	for i := range ids {
+		for j := range groups[i] {
+			z := b.convertToZ(groups[i][j])
+			// Lua indexes KEYS from 1
+			args = append(args, i+1, z.Score, z.Member)
+		}
+	}
+
+	var added int64
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		res, err := boundedAddScript.Run(rc, ids, args...).Result()
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		added, ok = res.(int64)
+		if !ok {
+			return errors.New("Added result has invalid type data")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		return ErrQueueFull
+	}
+
+	return nil
+}
+
+// laneID returns the key of the lane pm is routed to
+func (b *broker) laneID(pm PrioritizedMessage) string {
+	if len(b.lanes) == 0 || b.cfg.LaneSelector == nil {
+		return b.id
+	}
+
+	name := b.cfg.LaneSelector(pm.message.Body, pm.priority)
+	for i := range b.lanes {
+		if b.lanes[i].name == name {
+			return b.lanes[i].id
+		}
+	}
+
+	return b.id
+}
+
+// routeLanes groups messages by the keys of the lanes they are routed to
+func (b *broker) routeLanes(messages PrioritizedMessages) (ids []string, groups []PrioritizedMessages) {
+	if len(b.lanes) == 0 {
+		return []string{b.id}, []PrioritizedMessages{messages}
+	}
+
+	for i := range messages {
+		id := b.laneID(messages[i])
+		j := 0
+		for j < len(ids) && ids[j] != id {
+			j++
+		}
+		if j == len(ids) {
+			ids = append(ids, id)
+			groups = append(groups, nil)
+		}
+		groups[j] = append(groups[j], messages[i])
+	}
+
+	return
+}
+
+// newMessage creates a new message with the next sequence of the broker
+func (b *broker) newMessage(body []byte, priority float64, deliveries int) (PrioritizedMessage, error) {
+	return b.stamp(Message{
+		Deliveries: deliveries,
+		Body:       body,
+	}, priority)
+}
+
+// stamp stamps m put first with priority. The priority is kept in a header
+// when ReQueueResetPriority or Config.PriorityDecay can't tell it otherwise.
+func (b *broker) stamp(m Message, priority float64) (PrioritizedMessage, error) {
+	b.setStamp(&m)
+
+	if priority != b.cfg.DefaultPriority || b.cfg.PriorityDecay != nil {
+		headers := make(map[string]string, len(m.Headers)+1)
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+		headers[basePriorityHeader] = strconv.FormatFloat(priority, 'g', -1, 64)
+		if b.cfg.PriorityDecay != nil {
+			headers[putAtHeader] = strconv.FormatInt(m.Timestamp, 10)
+		}
+		m.Headers = headers
+	}
+
+	return b.encode(m, priority)
+}
+
+// restamp stamps m queued again keeping the headers given at the first put
+func (b *broker) restamp(m Message, priority float64) (PrioritizedMessage, error) {
+	b.setStamp(&m)
+	return b.encode(m, priority)
+}
+
+// setStamp sets the current time and the next sequence of the broker to m.
+// Stamps of a broker always increase so that messages with the same priority are FIFO
+// even in a burst or when the clock goes backwards.
+func (b *broker) setStamp(m *Message) {
+	now := b.now().UnixNano() / 1000
+
+	b.stampMu.Lock()
+	if now > b.lastTimestamp {
+		b.lastTimestamp = now
+		b.seq = 0
+	} else if b.seq+1 < seqModulo {
+		b.seq++
+	} else {
+		// Borrow the next microsecond when the sequence is used up
+		b.lastTimestamp++
+		b.seq = 0
+	}
+	m.Timestamp = b.lastTimestamp
+	m.Seq = b.seq
+	m.Node = b.node
+	b.stampMu.Unlock()
+}
+
+func (b *broker) encode(m Message, priority float64) (PrioritizedMessage, error) {
+	m.Priority = priority
+	stored := m
+	if len(m.Body) >= b.compressionThreshold {
+		var err error
+		stored, err = m.compress(b.compression)
+		if err != nil {
+			return PrioritizedMessage{}, err
+		}
+	}
+
+	member, err := b.codec.Encode(stored)
+	if err != nil {
+		return PrioritizedMessage{}, err
+	}
+
+	return PrioritizedMessage{
+		member:   string(member),
+		message:  m,
+		priority: priority,
+	}, nil
+}
+
+func (b *broker) decode(member string, priority float64) (PrioritizedMessage, error) {
+	m, err := b.codec.Decode([]byte(member))
+	if err != nil {
+		return PrioritizedMessage{}, err
+	}
+	m, err = m.decompress()
+	if err != nil {
+		return PrioritizedMessage{}, err
+	}
+
+	return PrioritizedMessage{
+		member:   member,
+		message:  m,
+		priority: priority,
+	}, nil
+}
+
+// score converts priority into the score sorted ascending by redis
+func (b *broker) score(priority float64) float64 {
+	if b.lowerIsHigher {
+		return priority
+	}
+
+	return -priority
+}
+
+// priority converts score back into the user facing priority
+func (b *broker) priority(score float64) float64 {
+	return b.score(score)
+}
+
+// convertToZ converts pm into a sorted set member whose score encodes the priority only.
+// Ties are broken by the member which starts with the stamp.
+func (b *broker) convertToZ(pm PrioritizedMessage) redis.Z {
+	return redis.Z{
+		Member: pm.member,
+		Score:  b.score(pm.priority),
+	}
+}
+
+func (b *broker) convertFromZ(zs []redis.Z) (messages PrioritizedMessages, err error) {
+	for i := range zs {
+		member, ok := zs[i].Member.(string)
+		if !ok {
+			err = errors.New("Member has invalid type data")
+			return
+		}
+		var m PrioritizedMessage
+		m, err = b.decode(member, b.priority(zs[i].Score))
+		if err != nil {
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	return
+}
+
+// refreshMembers counts a failed delivery and renews prefixes unless preserveOrder is set
+func (b *broker) refreshMembers(pm PrioritizedMessages, preserveOrder bool) error {
+	for i := range pm {
+		m := pm[i].message
+		// Fix the derived ID not to change with the new stamp
+		m.ID = m.id()
+		m.Deliveries++
+
+		var renewed PrioritizedMessage
+		var err error
+		if preserveOrder {
+			renewed, err = b.encode(m, pm[i].priority)
+		} else {
+			renewed, err = b.restamp(m, pm[i].priority)
+		}
+		if err != nil {
+			return err
+		}
+		pm[i] = renewed
+	}
+
+	return nil
+}
+
+// addUnlessPresent adds messages to the queue unless their original members are still there
+func (b *broker) addUnlessPresent(ctx context.Context, messages, originals PrioritizedMessages) error {
+	var ids []string
+	args := make(map[string][]interface{})
+	for i := range messages {
+		id := b.laneID(messages[i])
+		if _, ok := args[id]; !ok {
+			ids = append(ids, id)
+		}
+		z := b.convertToZ(messages[i])
+		args[id] = append(args[id], originals[i].member, z.Score, z.Member)
+	}
+
+	for _, id := range ids {
+		err := b.withContext(ctx, func(rc redisCmdable) error {
+			return addUnlessPresentScript.Run(rc, []string{id}, args[id]...).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putDelayed puts messages which become visible at readyAt
+func (b *broker) putDelayed(ctx context.Context, readyAt time.Time, messages ...PrioritizedMessage) error {
+	err := b.checkSize(messages)
+	if err != nil {
+		return err
+	}
+
+	err = b.addDelayed(ctx, readyAt, messages...)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&b.stats.Put, int64(len(messages)))
+	return nil
+}
+
+func (b *broker) addDelayed(ctx context.Context, readyAt time.Time, messages ...PrioritizedMessage) error {
+	score := float64(readyAt.UnixNano() / 1000)
+
+	ids, groups := b.routeLanes(messages)
+	for i := range ids {
+		var data []redis.Z
+		for j := range groups[i] {
+			z := b.convertToZ(groups[i][j])
+			data = append(data, redis.Z{
+				Member: strconv.FormatFloat(z.Score, 'g', -1, 64) + delayedSeparator + groups[i][j].member,
+				Score:  score,
+			})
+		}
+
+		err := b.withContext(ctx, func(rc redisCmdable) error {
+			return rc.ZAdd(ids[i]+delayedSuffix, data...).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isDead reports whether m has used up its deliveries
+func (b *broker) isDead(m PrioritizedMessage) bool {
+	return b.maxDeliveries > 0 && m.message.Deliveries >= b.maxDeliveries
+}
+
+// get claims num messages with scores up to maxScore skipping expired ones.
+// Expired messages are removed as they are found.
+func (b *broker) get(ctx context.Context, num int64, maxScore string) (messages PrioritizedMessages, err error) {
+	script := b.takeScript(claimScript, popScript)
+	return b.getLanes(ctx, num, func(ctx context.Context, id, delayedID string, num int64) (PrioritizedMessages, error) {
+		return b.getFrom(ctx, script, id, delayedID, num, maxScore)
+	})
+}
+
+// takeScript returns claim, or pop which removes messages on get with AtMostOnce
+func (b *broker) takeScript(claim, pop *redis.Script) *redis.Script {
+	if b.deliveryMode == AtMostOnce {
+		return pop
+	}
+
+	return claim
+}
+
+// getLanes draws num messages by take from lanes in proportion to their weights.
+// Shares of lanes running out are drawn from the others. Without lanes it takes them from the queue.
+func (b *broker) getLanes(ctx context.Context, num int64, take func(ctx context.Context, id, delayedID string, num int64) (PrioritizedMessages, error)) (messages PrioritizedMessages, err error) {
+	if len(b.lanes) == 0 {
+		return take(ctx, b.id, b.delayedID, num)
+	}
+
+	exhausted := make([]bool, len(b.lanes))
+	for want := num; want > 0 || num <= 0; {
+		shares := b.drawShares(want, exhausted)
+		if shares == nil {
+			return
+		}
+
+		for i, share := range shares {
+			if share == 0 {
+				continue
+			}
+
+			var claimed PrioritizedMessages
+			claimed, err = take(ctx, b.lanes[i].id, b.lanes[i].delayedID, share)
+			if err != nil {
+				if len(messages) != 0 {
+					// Keep messages already claimed
+					b.logger.Printf("mq: failed to claim messages of %s: %v", b.lanes[i].id, err)
+					err = nil
+				}
+				return
+			}
+
+			messages = append(messages, claimed...)
+			want -= int64(len(claimed))
+			if num <= 0 || int64(len(claimed)) < share {
+				exhausted[i] = true
+			}
+		}
+	}
+
+	return
+}
+
+// drawShares splits num among lanes not exhausted by smooth weighted round robin.
+// num <= 0 gives every lane a share of all messages. It returns nil when all lanes are exhausted.
+func (b *broker) drawShares(num int64, exhausted []bool) []int64 {
+	total := 0
+	for i := range b.lanes {
+		if !exhausted[i] {
+			total += b.lanes[i].weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	shares := make([]int64, len(b.lanes))
+	if num <= 0 {
+		for i := range shares {
+			if !exhausted[i] {
+				shares[i] = -1
+			}
+		}
+		return shares
+	}
+
+	b.laneMu.Lock()
+	defer b.laneMu.Unlock()
+
+	for n := int64(0); n < num; n++ {
+		best := -1
+		for i := range b.lanes {
+			if exhausted[i] {
+				continue
+			}
+			b.lanes[i].current += b.lanes[i].weight
+			if best < 0 || b.lanes[i].current > b.lanes[best].current {
+				best = i
+			}
+		}
+		b.lanes[best].current -= total
+		shares[best]++
+	}
+
+	return shares
+}
+
+// getFair claims num messages at the head of the queue taking turns among producers.
+// Lanes are drawn like get and producers take turns within each lane.
+func (b *broker) getFair(ctx context.Context, num int64) (PrioritizedMessages, error) {
+	if num <= 0 {
+		return b.get(ctx, num, noScoreLimit)
+	}
+
+	return b.getLanes(ctx, num, b.getFairFrom)
+}
+
+// getFairFrom claims num messages of the sorted set id taking turns among producers.
+// Delayed messages ready are promoted beforehand, and expired messages at the head are removed
+// so that they don't fill the window considered.
+func (b *broker) getFairFrom(ctx context.Context, id, delayedID string, num int64) (PrioritizedMessages, error) {
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		keys := []string{id, b.processingID, delayedID}
+		return promoteScript.Run(rc, keys, num, b.now().UnixNano()/1000).Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		head, err := b.peek(id, 0, num*fairWindow-1)
+		if err != nil {
+			return nil, err
+		}
+
+		now := b.now().UnixNano() / 1000
+		var producers []string
+		var expired []interface{}
+		queues := make(map[string]PrioritizedMessages)
+		for i := range head {
+			if head[i].message.expired(now) {
+				expired = append(expired, head[i].member)
+				continue
+			}
+			p := head[i].Producer()
+			if _, ok := queues[p]; !ok {
+				producers = append(producers, p)
+			}
+			queues[p] = append(queues[p], head[i])
+		}
+
+		if len(expired) != 0 {
+			err = b.withContext(ctx, func(rc redisCmdable) error {
+				return rc.ZRem(id, expired...).Err()
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(producers) == 0 {
+				// The window was full of expired messages, so look behind them
+				continue
+			}
+		}
+
+		var picked []interface{}
+		for int64(len(picked)) < num && len(producers) != 0 {
+			var rest []string
+			for _, p := range producers {
+				if int64(len(picked)) == num {
+					break
+				}
+				picked = append(picked, queues[p][0].member)
+				queues[p] = queues[p][1:]
+				if len(queues[p]) != 0 {
+					rest = append(rest, p)
+				}
+			}
+			producers = rest
+		}
+		if len(picked) == 0 {
+			return nil, nil
+		}
+
+		messages, _, err := b.claimMembers(ctx, id, picked)
+		return messages, err
+	}
+}
+
+// getFrom claims messages from the sorted set id and its delayed set by script like get
+func (b *broker) getFrom(ctx context.Context, script *redis.Script, id, delayedID string, num int64, maxScore string) (messages PrioritizedMessages, err error) {
+	want := num
+	for {
+		var claimed PrioritizedMessages
+		var count int64
+		claimed, count, err = b.claim(ctx, script, id, delayedID, want, maxScore)
+		if err != nil {
+			if len(messages) != 0 {
+				// Keep messages already claimed
+				b.logger.Printf("mq: failed to claim messages of %s: %v", b.id, err)
+				err = nil
+			}
+			return
+		}
+
+		now := b.now().UnixNano() / 1000
+		var expired PrioritizedMessages
+		for i := range claimed {
+			if claimed[i].message.expired(now) {
+				expired = append(expired, claimed[i])
+			} else {
+				messages = append(messages, claimed[i])
+			}
+		}
+		if len(expired) == 0 && int64(len(claimed)) == count {
+			return
+		}
+
+		if len(expired) != 0 {
+			removeErr := b.release(ctx, expired.getMembers())
+			if removeErr != nil {
+				b.logger.Printf("mq: failed to remove expired messages of %s: %v", b.id, removeErr)
+			}
+		}
+
+		// Claim again for skipped ones unless the queue is exhausted
+		if num <= 0 || count < want {
+			return messages, nil
+		}
+		want = num - int64(len(messages))
+	}
+}
+
+// claim moves num messages of id into the processing set by script and returns them with the number of claimed members.
+// Malformed members are moved to the dead letter queue and skipped.
+func (b *broker) claim(ctx context.Context, script *redis.Script, id, delayedID string, num int64, maxScore string) (messages PrioritizedMessages, count int64, err error) {
+	var vals []interface{}
+	err = b.withContext(ctx, func(rc redisCmdable) error {
+		keys := []string{id, b.processingID, delayedID, b.claimsID}
+		now := b.now().UnixNano() / 1000
+		res, err := script.Run(rc, keys, num, now, maxScore).Result()
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		vals, ok = res.([]interface{})
+		if !ok {
+			return errors.New("Claimed result has invalid type data")
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	return b.decodeClaimed(ctx, vals)
+}
+
+// claimMembers moves members still waiting in the sorted set id into the processing set and returns them
+// with the number of claimed members. Malformed members are moved to the dead letter queue and skipped.
+func (b *broker) claimMembers(ctx context.Context, id string, members []interface{}) (messages PrioritizedMessages, count int64, err error) {
+	var vals []interface{}
+	err = b.withContext(ctx, func(rc redisCmdable) error {
+		args := append([]interface{}{b.now().UnixNano() / 1000}, members...)
+		res, err := b.takeScript(claimMembersScript, popMembersScript).Run(rc, []string{id, b.processingID, b.claimsID}, args...).Result()
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		vals, ok = res.([]interface{})
+		if !ok {
+			return errors.New("Claimed result has invalid type data")
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	return b.decodeClaimed(ctx, vals)
+}
+
+// decodeClaimed decodes pairs of member and score claimed by scripts.
+// Malformed members are moved from the processing set to the dead letter queue with their scores and skipped.
+func (b *broker) decodeClaimed(ctx context.Context, vals []interface{}) (messages PrioritizedMessages, count int64, err error) {
+	if len(vals) == 0 {
+		return
+	}
+
+	var malformed []interface{}
+	for i := 0; i+1 < len(vals); i += 2 {
+		count++
+
+		member, ok := vals[i].(string)
+		if !ok {
+			err = errors.New("Member has invalid type data")
+			return
+		}
+		score, ok := vals[i+1].(string)
+		if !ok {
+			err = errors.New("Score has invalid type data")
+			return
+		}
+		var z float64
+		z, err = strconv.ParseFloat(score, 64)
+		if err != nil {
+			return
+		}
+		m, decodeErr := b.decode(member, b.priority(z))
+		if decodeErr != nil {
+			b.logger.Printf("mq: skipped malformed member %q of %s: %v", member, b.id, decodeErr)
+			malformed = append(malformed, z, member)
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	if len(malformed) != 0 {
+		buryErr := b.withContext(ctx, func(rc redisCmdable) error {
+			return buryScript.Run(rc, []string{b.deadID, b.processingID, b.claimsID}, malformed...).Err()
+		})
+		if buryErr != nil {
+			// They stay claimed to be recovered later
+			b.logger.Printf("mq: failed to move malformed members of %s to the dead letter queue: %v", b.id, buryErr)
+		}
+	}
+
+	return
+}
+
+// release removes claimed members from the processing set with their scores kept for Recover
+func (b *broker) release(ctx context.Context, members []string) error {
+	return b.withContext(ctx, func(rc redisCmdable) error {
+		_, err := rc.Pipelined(func(pipe *redis.Pipeline) error {
+			for i := range members {
+				pipe.ZRem(b.processingID, members[i])
+			}
+			pipe.HDel(b.claimsID, members...)
+			return nil
+		})
+		return err
+	})
+}
+
+// unclaim moves claimed messages back into their lanes with the members and scores they had as if they were never claimed.
+// Messages left claimed on failure are recovered by Recover.
+func (b *broker) unclaim(messages PrioritizedMessages) error {
+	lanes := make(map[string][]interface{})
+	for i := range messages {
+		id := b.laneID(messages[i])
+		lanes[id] = append(lanes[id], messages[i].member)
+	}
+
+	for id, members := range lanes {
+		err := b.withContext(context.Background(), func(rc redisCmdable) error {
+			return unclaimScript.Run(rc, []string{id, b.processingID, b.claimsID}, members...).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recover queues messages claimed up to olderThan ago again and returns the number of them
+func (b *broker) recover(ctx context.Context, olderThan time.Duration) (int, error) {
+	now := b.now()
+	var vals []interface{}
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		keys := []string{b.processingID, b.claimsID}
+		res, err := recoverScript.Run(rc, keys, now.Add(-olderThan).UnixNano()/1000, now.UnixNano()/1000).Result()
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		vals, ok = res.([]interface{})
+		if !ok {
+			return errors.New("Recovered result has invalid type data")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	messages, _, err := b.decodeClaimed(ctx, vals)
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	// Queue them again as if a consumer of this broker had claimed them
+	c := &Consumer{
+		broker:           b,
+		notAckedMessages: messages,
+	}
+	atomic.AddInt64(&b.inFlight, int64(len(messages)))
+	err = c.ReQueue()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(messages), nil
+}
+
+// peek gets messages in the range of key without claiming them
+func (b *broker) peek(key string, start, stop int64) (PrioritizedMessages, error) {
+	return b.peekWith(func(rc redisCmdable) *redis.ZSliceCmd {
+		return rc.ZRangeWithScores(key, start, stop)
+	})
+}
+
+// peekTail gets messages in the range of key counted from the tail without claiming them
+func (b *broker) peekTail(key string, start, stop int64) (PrioritizedMessages, error) {
+	return b.peekWith(func(rc redisCmdable) *redis.ZSliceCmd {
+		return rc.ZRevRangeWithScores(key, start, stop)
+	})
+}
+
+func (b *broker) peekWith(fn func(rc redisCmdable) *redis.ZSliceCmd) (PrioritizedMessages, error) {
+	var vals []redis.Z
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		res := fn(rc)
+		vals = res.Val()
+		return res.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.convertFromZ(vals)
+}
+
+// newRedisClient creates a cluster client when ClusterAddrs is set
+// and a sentinel backed client when SentinelAddrs is set
+func newRedisClient(cfg Config) redisCmdable {
+	if len(cfg.ClusterAddrs) != 0 {
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        cfg.ClusterAddrs,
+			Password:     cfg.RedisPassword,
+			PoolSize:     cfg.PoolSize,
+			DialTimeout:  cfg.DialTimeout,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+		})
+	}
+
+	if len(cfg.SentinelAddrs) != 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.SentinelAddrs,
+			Password:      cfg.RedisPassword,
+			DB:            cfg.RedisDB,
+			PoolSize:      cfg.PoolSize,
+			DialTimeout:   cfg.DialTimeout,
+			ReadTimeout:   cfg.ReadTimeout,
+			WriteTimeout:  cfg.WriteTimeout,
+		})
+	}
+
+	return redis.NewClient(&redis.Options{
+		Addr:         cfg.RedisAddr,
+		Password:     cfg.RedisPassword,
+		DB:           cfg.RedisDB,
+		PoolSize:     cfg.PoolSize,
+		DialTimeout:  cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		TLSConfig:    cfg.TLSConfig,
+		OnConnect: func(*redis.Conn) error {
+			if cfg.OnConnect != nil {
+				cfg.OnConnect()
+			}
+			return nil
+		},
+	})
+}
+
+// NewPriorityMQ creates a new message queue
+func NewPriorityMQ(cfg Config) (*MessageQueue, error) {
+	if cfg.PriorityDecay != nil && cfg.AgingRate != 0 {
+		return nil, ErrDecayWithAging
+	}
+
+	rc := newRedisClient(cfg)
+
+	// Make redis connect sure
+	res := rc.Ping()
+	if err := res.Err(); err != nil {
+		rc.Close()
+		return nil, &ConnectError{Err: err}
+	}
+
+	return newPriorityMQ(cfg, rc, true), nil
+}
+
+// NewPriorityMQWithClient creates a new message queue named name on client.
+// Close leaves client open since it is owned by the caller, even after Config.CloseTimeout.
+func NewPriorityMQWithClient(name string, client *redis.Client) (*MessageQueue, error) {
+	cfg := Config{
+		Name: name,
+	}
+
+	res := client.Ping()
+	if err := res.Err(); err != nil {
+		return nil, &ConnectError{Err: err}
+	}
+
+	return newPriorityMQ(cfg, client, false), nil
+}
+
+// newPriorityMQ starts a message queue for cfg on rc which is closed with it when ownsClient is set
+func newPriorityMQ(cfg Config, rc redisCmdable, ownsClient bool) *MessageQueue {
+	ackWorkers := cfg.AckWorkers
+	if ackWorkers <= 0 {
+		ackWorkers = 1
+	}
+
+	connected := int32(1)
+	broker := newBroker(cfg, &broker{
+		connected:    &connected,
+		ownsClient:   ownsClient,
+		redisClient:  rc,
+		consumerAckC: make(chan *consumerAck, ackWorkers),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+		closeOnce:    &sync.Once{},
+		workers:      &sync.WaitGroup{},
+	})
+	broker.startAckListner(ackWorkers)
+	broker.startWorkers()
+	if cfg.HealthCheckInterval > 0 {
+		broker.startHealthCheck(cfg.HealthCheckInterval)
+	}
+
+	return &MessageQueue{
+		broker: broker,
+	}
+}
+
+// newBroker creates a broker for cfg sharing the connection and the ack listener of shared
+func newBroker(cfg Config, shared *broker) *broker {
+	codec := cfg.Codec
+	if codec == nil {
+		codec = PrefixCodec{}
+	}
+
+	var logger Logger = nopLogger{}
+	if cfg.Logger != nil {
+		logger = cfg.Logger
+	}
+
+	compressionThreshold := cfg.CompressionThreshold
+	if compressionThreshold <= 0 {
+		compressionThreshold = defaultCompressionThreshold
+	}
+
+	var archiveSize int64
+	if cfg.ArchiveAcked {
+		archiveSize = cfg.ArchiveSize
+		if archiveSize <= 0 {
+			archiveSize = defaultArchiveSize
+		}
+	}
+
+	closeTimeout := cfg.CloseTimeout
+	if closeTimeout <= 0 {
+		closeTimeout = defaultCloseTimeout
+	}
+
+	now := cfg.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	key := cfg.key()
+	var lanes []lane
+	for i, l := range cfg.Lanes {
+		weight := l.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		id := key
+		if i > 0 {
+			id = key + laneSuffix + l.Name
+		}
+		lanes = append(lanes, lane{
+			name:      l.Name,
+			weight:    weight,
+			id:        id,
+			delayedID: id + delayedSuffix,
+		})
+	}
+
+	return &broker{
+		cfg:                  cfg,
+		codec:                codec,
+		compression:          cfg.Compression,
+		compressionThreshold: compressionThreshold,
+		logger:               logger,
+		maxRetries:           cfg.MaxRetries,
+		closeTimeout:         closeTimeout,
+		node:                 newNode(),
+		id:                   key,
+		processingID:         key + processingSuffix,
+		claimsID:             key + claimsSuffix,
+		deadID:               key + deadSuffix,
+		delayedID:            key + delayedSuffix,
+		archiveID:            key + archiveSuffix,
+		eventsID:             key + eventsSuffix,
+		archiveSize:          archiveSize,
+		maxDeliveries:        cfg.MaxDeliveries,
+		maxClaimed:           cfg.MaxClaimed,
+		maxGetBatch:          cfg.MaxGetBatch,
+		maxLen:               cfg.MaxLen,
+		maxMessageBytes:      cfg.MaxMessageBytes,
+		lowerIsHigher:        cfg.LowerIsHigher,
+		deliveryMode:         cfg.DeliveryMode,
+		now:                  now,
+		redisClient:          shared.redisClient,
+		consumerAckC:         shared.consumerAckC,
+		quit:                 shared.quit,
+		done:                 shared.done,
+		closeOnce:            shared.closeOnce,
+		workers:              shared.workers,
+		connected:            shared.connected,
+		ownsClient:           shared.ownsClient,
+		lanes:                lanes,
+	}
+}
+
+// newNode returns random hex digits telling brokers apart.
+// The process ID is used when the random source fails.
+func newNode() string {
+	buf := make([]byte, nodeLength/2)
+	if _, err := crand.Read(buf); err != nil {
+		return fmt.Sprintf("%0*x", nodeLength, uint32(os.Getpid()))
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// startWorkers starts background loops configured for the broker
+func (b *broker) startWorkers() {
+	if b.cfg.AgingRate != 0 {
+		interval := b.cfg.AgingInterval
+		if interval <= 0 {
+			interval = defaultAgingInterval
+		}
+		b.startAging(b.cfg.AgingRate, interval)
+	} else if b.cfg.PriorityDecay != nil {
+		interval := b.cfg.AgingInterval
+		if interval <= 0 {
+			interval = defaultAgingInterval
+		}
+		b.startDecay(interval)
+	}
+	if b.cfg.VisibilityTimeout > 0 {
+		b.startRecovery(b.cfg.VisibilityTimeout)
+	}
+}
+
+// Queue returns a message queue named name which shares the connection and the ack listener with mq.
+// Settings other than Name are the same as mq.
+// Closing any of the queues sharing the connection closes all of them.
+func (mq *MessageQueue) Queue(name string) *MessageQueue {
+	cfg := mq.broker.cfg
+	cfg.Name = name
+
+	broker := newBroker(cfg, mq.broker)
+	if !broker.isClosed() {
+		broker.startWorkers()
+	}
+
+	return &MessageQueue{
+		broker: broker,
+	}
+}
+
+// Put puts message and priority
+func (mq *MessageQueue) Put(body []byte, priority float64) error {
+	return mq.PutContext(context.Background(), body, priority)
+}
+
+// PutInt puts message with an integer level as its priority.
+// Scores hold levels exactly, and they are ordered with float priorities on the same queue.
+func (mq *MessageQueue) PutInt(body []byte, level int) error {
+	return mq.Put(body, float64(level))
+}
+
+// PutDefault puts message with Config.DefaultPriority
+func (mq *MessageQueue) PutDefault(body []byte) error {
+	return mq.Put(body, mq.broker.cfg.DefaultPriority)
+}
+
+// PutContext puts message and priority.
+// It returns ctx.Err() when ctx is done before the message is sent to redis.
+// Once sent, it waits for the response so that the result is reported even if ctx is done meanwhile.
+func (mq *MessageQueue) PutContext(ctx context.Context, body []byte, priority float64) error {
+	m, err := mq.broker.newMessage(body, priority, 0)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.put(ctx, m)
+}
+
+// PutMessage puts message and priority and returns the message put.
+// It is a handle to cancel the message by Remove or change its priority by UpdatePriority.
+func (mq *MessageQueue) PutMessage(body []byte, priority float64) (PrioritizedMessage, error) {
+	m, err := mq.broker.newMessage(body, priority, 0)
+	if err != nil {
+		return PrioritizedMessage{}, err
+	}
+
+	err = mq.broker.put(context.Background(), m)
+	if err != nil {
+		return PrioritizedMessage{}, err
+	}
+
+	return m, nil
+}
+
+// PutWithTTL puts message and priority which expires after ttl.
+// Expired messages are never returned from Get and removed when they are found.
+func (mq *MessageQueue) PutWithTTL(body []byte, priority float64, ttl time.Duration) error {
+	m, err := mq.broker.stamp(Message{
+		ExpiresAt: mq.broker.now().Add(ttl).UnixNano() / 1000,
+		Body:      body,
+	}, priority)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.put(context.Background(), m)
+}
+
+// PutWithHeaders puts message and priority with headers.
+// It returns ErrReservedHeader for headers prefixed with "pmq-".
+func (mq *MessageQueue) PutWithHeaders(body []byte, priority float64, headers map[string]string) error {
+	// Copy not to share the map with callers
+	copied := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if strings.HasPrefix(k, reservedHeaderPrefix) {
+			return ErrReservedHeader
+		}
+		copied[k] = v
+	}
+
+	m, err := mq.broker.stamp(Message{
+		Headers: copied,
+		Body:    body,
+	}, priority)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.put(context.Background(), m)
+}
+
+// PutWithID puts message and priority identified by id
+func (mq *MessageQueue) PutWithID(id string, body []byte, priority float64) error {
+	if id == "" {
+		return errors.New("ID is empty")
+	}
+
+	m, err := mq.broker.stamp(Message{
+		ID:   id,
+		Body: body,
+	}, priority)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.put(context.Background(), m)
+}
+
+// PutUnique puts message and priority unless the same body has been put by PutUnique within window.
+// It returns false without putting when the body is a duplicate, and ErrInvalidWindow when window is not positive
+// since the body would be marked forever.
+func (mq *MessageQueue) PutUnique(body []byte, priority float64, window time.Duration) (bool, error) {
+	if window <= 0 {
+		return false, ErrInvalidWindow
+	}
+
+	m, err := mq.broker.newMessage(body, priority, 0)
+	if err != nil {
+		return false, err
+	}
+
+	b := mq.broker
+	sum := sha1.Sum(body)
+	key := b.id + uniqueSuffix + hex.EncodeToString(sum[:])
+
+	var ok bool
+	err = b.withContext(context.Background(), func(rc redisCmdable) error {
+		var err error
+		ok, err = rc.SetNX(key, 1, window).Result()
+		return err
+	})
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = b.put(context.Background(), m)
+	if err != nil {
+		// Let the body be put again
+		b.withContext(context.Background(), func(rc redisCmdable) error {
+			return rc.Del(key).Err()
+		})
+		return false, err
+	}
+
+	return true, nil
+}
+
+// PutFrom puts message and priority tagged with producerID so that GetFair takes turns among producers
+func (mq *MessageQueue) PutFrom(producerID string, body []byte, priority float64) error {
+	m, err := mq.broker.stamp(Message{
+		Headers: map[string]string{producerHeader: producerID},
+		Body:    body,
+	}, priority)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.put(context.Background(), m)
+}
+
+// PutBatch puts messages and priorities in one round trip.
+// bodies and priorities must have the same length.
+func (mq *MessageQueue) PutBatch(bodies [][]byte, priorities []float64) error {
+	if len(bodies) != len(priorities) {
+		return errors.New("Bodies and priorities have different lengths")
+	}
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	messages := make(PrioritizedMessages, 0, len(bodies))
+	for i := range bodies {
+		m, err := mq.broker.newMessage(bodies[i], priorities[i], 0)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, m)
+	}
+
+	return mq.broker.put(context.Background(), messages...)
+}
+
+// PutDelayed puts message and priority which is not delivered until delay elapses
+func (mq *MessageQueue) PutDelayed(body []byte, priority float64, delay time.Duration) error {
+	m, err := mq.broker.newMessage(body, priority, 0)
+	if err != nil {
+		return err
+	}
+
+	return mq.broker.putDelayed(context.Background(), mq.broker.now().Add(delay), m)
+}
+
+// Len returns the number of messages waiting in the queue including all lanes.
+// Delayed messages which are not ready yet are not counted.
+func (mq *MessageQueue) Len() (l int64, err error) {
+	return mq.broker.len()
+}
+
+func (b *broker) len() (l int64, err error) {
+	for _, id := range b.laneIDs() {
+		err = b.withContext(context.Background(), func(rc redisCmdable) error {
+			n, err := rc.ZCard(id).Result()
+			l += n
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return
+}
+
+// Purge deletes all messages in the queue including claimed, delayed, archived and dead ones
+func (mq *MessageQueue) Purge() error {
+	b := mq.broker
+	keys := []string{b.processingID, b.claimsID, b.archiveID, b.deadID}
+	for _, id := range b.laneIDs() {
+		keys = append(keys, id, id+delayedSuffix, id+agedSuffix)
+	}
+
+	return b.withContext(context.Background(), func(rc redisCmdable) error {
+		return rc.Del(keys...).Err()
+	})
+}
+
+// laneIDs returns the keys of all lanes. It is only the queue key without lanes.
+func (b *broker) laneIDs() []string {
+	if len(b.lanes) == 0 {
+		return []string{b.id}
+	}
+
+	ids := make([]string, 0, len(b.lanes))
+	for i := range b.lanes {
+		ids = append(ids, b.lanes[i].id)
+	}
+
+	return ids
+}
+
+// Remove removes pm waiting in the queue or delayed so that it is never delivered.
+// It returns false when pm is not waiting, e.g. it has already been claimed or removed.
+func (mq *MessageQueue) Remove(pm PrioritizedMessage) (bool, error) {
+	b := mq.broker
+	id := b.laneID(pm)
+	z := b.convertToZ(pm)
+	delayed := strconv.FormatFloat(z.Score, 'g', -1, 64) + delayedSeparator + pm.member
+
+	var removed int64
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		var err error
+		removed, err = rc.ZRem(id, pm.member).Result()
+		if err != nil || removed != 0 {
+			return err
+		}
+		removed, err = rc.ZRem(id+delayedSuffix, delayed).Result()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return removed != 0, nil
+}
+
+// AckByMember removes claimed members from redis without the state of the consumer which got them
+// so that they can be acked by another process. It returns the members which were claimed.
+// Consumers holding the members still count them as claimed until they ack them, and they are not archived.
+func (mq *MessageQueue) AckByMember(members ...string) ([]string, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	b := mq.broker
+	cmds := make([]*redis.IntCmd, len(members))
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		_, err := rc.Pipelined(func(pipe *redis.Pipeline) error {
+			for i := range members {
+				cmds[i] = pipe.ZRem(b.processingID, members[i])
+			}
+			pipe.HDel(b.claimsID, members...)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var acked []string
+	for i := range cmds {
+		if cmds[i].Val() != 0 {
+			acked = append(acked, members[i])
+		}
+	}
+	atomic.AddInt64(&b.stats.Acked, int64(len(acked)))
+
+	return acked, nil
+}
+
+// Recover queues messages claimed more than olderThan ago and not acked yet again
+// so that messages of consumers which crashed or were dropped are delivered again.
+// Their deliveries count up and Config.MaxDeliveries applies as with ReQueue.
+// Messages held longer by live consumers are delivered twice, and acking them later does nothing.
+// It returns the number of recovered messages.
+func (mq *MessageQueue) Recover(olderThan time.Duration) (int, error) {
+	return mq.broker.recover(context.Background(), olderThan)
+}
+
+// QuarantineAll moves all waiting and delayed messages into the dead letter queue atomically
+// and returns the number of them. Claimed messages are not moved.
+func (mq *MessageQueue) QuarantineAll() (int, error) {
+	b := mq.broker
+	ids := b.laneIDs()
+	keys := append([]string{b.deadID}, ids...)
+	for _, id := range ids {
+		keys = append(keys, id+delayedSuffix)
+	}
+
+	var moved int64
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		res, err := quarantineScript.Run(rc, keys, len(ids)).Result()
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		moved, ok = res.(int64)
+		if !ok {
+			return errors.New("Moved result has invalid type data")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(moved), nil
+}
+
+// WaitAcked waits until pm put by PutMessage is removed from the queue by Ack.
+// It returns nil at once when pm has already been acked, and ctx.Err() when ctx is done first.
+// Since members change when messages are queued again or moved to the dead letter queue, it returns on them too.
+func (mq *MessageQueue) WaitAcked(ctx context.Context, pm PrioritizedMessage) error {
+	b := mq.broker
+	id := b.laneID(pm)
+	z := b.convertToZ(pm)
+	delayed := strconv.FormatFloat(z.Score, 'g', -1, 64) + delayedSeparator + pm.member
+	keys := []string{id, b.processingID, id + delayedSuffix}
+
+	ticker := time.NewTicker(blockingPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var exists int64
+		err := b.withContext(ctx, func(rc redisCmdable) error {
+			res, err := memberExistsScript.Run(rc, keys, pm.member, pm.member, delayed).Result()
+			if err != nil {
+				return err
+			}
+
+			var ok bool
+			exists, ok = res.(int64)
+			if !ok {
+				return errors.New("Exists result has invalid type data")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Info returns the usage of redis by waiting messages.
+// It scans all of them to find the oldest and the newest ones, so it is slow for large queues.
+func (mq *MessageQueue) Info() (info QueueInfo, err error) {
+	b := mq.broker
+	ctx := context.Background()
+
+	info.Len, err = b.len()
+	if err != nil {
+		return
+	}
+
+	for _, id := range b.laneIDs() {
+		cmd := redis.NewIntCmd("memory", "usage", id)
+		err = b.withContext(ctx, func(rc redisCmdable) error {
+			rc.Process(cmd)
+			return cmd.Err()
+		})
+		if err == redis.Nil {
+			// The key doesn't exist
+			continue
+		}
+		if err == ErrClosed || err == ErrNotConnected || isConnError(err) {
+			return
+		}
+		if err != nil {
+			// Servers older than 4.0 don't know MEMORY USAGE
+			b.logger.Printf("mq: failed to get memory usage of %s: %v", id, err)
+			info.MemoryUsage = -1
+			break
+		}
+		info.MemoryUsage += cmd.Val()
+	}
+
+	var oldest, newest int64
+	for _, id := range b.laneIDs() {
+		err = b.scan(ctx, id, func(m PrioritizedMessage) bool {
+			ts := m.message.Timestamp
+			if oldest == 0 || ts < oldest {
+				oldest = ts
+			}
+			if ts > newest {
+				newest = ts
+			}
+			return true
+		})
+		if err != nil {
+			return
+		}
+	}
+	if newest != 0 {
+		info.Oldest = time.Unix(0, oldest*1000)
+		info.Newest = time.Unix(0, newest*1000)
+	}
+
+	return info, nil
+}
+
+// Archive gets the last num acked messages from the newest when Config.ArchiveAcked is set
+func (mq *MessageQueue) Archive(num int64) (PrioritizedMessages, error) {
+	if num <= 0 {
+		return nil, nil
+	}
+
+	b := mq.broker
+	var vals []string
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		var err error
+		vals, err = rc.LRange(b.archiveID, 0, num-1).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var messages PrioritizedMessages
+	for i := range vals {
+		sep := strings.Index(vals[i], delayedSeparator)
+		if sep < 0 {
+			return nil, errors.New("Archived member has no score")
+		}
+		score, err := strconv.ParseFloat(vals[i][:sep], 64)
+		if err != nil {
+			return nil, err
+		}
+		m, err := b.decode(vals[i][sep+len(delayedSeparator):], b.priority(score))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// DeadLetters gets messages moved to the dead letter queue without removing them
+func (mq *MessageQueue) DeadLetters(num int64) (PrioritizedMessages, error) {
+	return mq.broker.peek(mq.broker.deadID, 0, num-1)
+}
+
+// Stats returns counters of messages put, gotten, acked and requeued by this instance
+// and the current length of the queue
+func (mq *MessageQueue) Stats() Stats {
+	b := mq.broker
+	stats := Stats{
+		Put:      atomic.LoadInt64(&b.stats.Put),
+		Gotten:   atomic.LoadInt64(&b.stats.Gotten),
+		Acked:    atomic.LoadInt64(&b.stats.Acked),
+		ReQueued: atomic.LoadInt64(&b.stats.ReQueued),
+	}
+
+	l, err := mq.Len()
+	if err != nil {
+		l = -1
+	}
+	stats.Len = l
+
+	return stats
+}
+
+// Ping checks the connection to redis without retrying.
+// It returns ErrClosed after Close.
+func (mq *MessageQueue) Ping() error {
+	return mq.broker.do(context.Background(), func(rc redisCmdable) error {
+		return rc.Ping().Err()
+	})
+}
+
+// RedisClient returns the redis client used by the message queue for auxiliary commands.
+// It returns nil in cluster mode. Modifying the keys of the queue directly is not supported.
+func (mq *MessageQueue) RedisClient() *redis.Client {
+	rc, _ := mq.broker.redisClient.(*redis.Client)
+	return rc
+}
+
+// Close close message queue.
+// It is safe to call Close more than once, and operations after Close return ErrClosed.
+func (mq *MessageQueue) Close() {
+	mq.broker.close()
+}
+
+// CloseGraceful waits until all claimed messages are acked or requeued and closes message queue.
+// When ctx is done first, it closes anyway and returns an error reporting the messages still in flight.
+func (mq *MessageQueue) CloseGraceful(ctx context.Context) error {
+	defer mq.broker.close()
+
+	ticker := time.NewTicker(blockingPollInterval)
+	defer ticker.Stop()
+
+	for {
+		n := atomic.LoadInt64(&mq.broker.inFlight)
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d messages are still in flight: %v", n, ctx.Err())
+		}
+	}
+}
+
+// GetReader returns a reader of the queue sharing the connection
+func (mq *MessageQueue) GetReader() *Reader {
+	return &Reader{
+		broker: mq.broker,
+	}
+}
+
+func (mq *MessageQueue) GetConsumer() *Consumer {
+	c := &Consumer{
+		broker: mq.broker,
+	}
+
+	return c
+}
+
+// Get gets bodies and priorities.
+// Messages are delivered strictly by priority and by the order they are put within the same priority,
+// since the score is the priority only and PrefixCodec prefixes members with monotonic stamps of the broker.
+// Messages queued again are ordered by the time they are queued unless ReQueuePreserveOrder is used,
+// and aging, other codecs and stamps of different clients with skewed clocks relax the latter.
+// Returned messages are claimed by the consumer and never handed to another one until ReQueue.
+// Get returns the same batch again while none of it is acked or queued again.
+// Once any claimed message is acked, Get fetches new messages and the rest of the batch stays claimed.
+func (c *Consumer) Get(num int64) (messages PrioritizedMessages, err error) {
+	return c.GetContext(context.Background(), num)
+}
+
+// GetContext gets bodies and priorities.
+// It returns ctx.Err() when ctx is done before redis responds, putting back messages claimed meanwhile
+// with their original positions so that none of them is lost.
+// Returning the same batch again doesn't count toward Config.MaxClaimed but fetching new messages does.
+func (c *Consumer) GetContext(ctx context.Context, num int64) (messages PrioritizedMessages, err error) {
+	return c.get(ctx, num, noScoreLimit)
+}
+
+// GetNewest gets bodies and priorities taking the newest message first among those with the same priority.
+// Messages of higher priority still come first, and lanes are drawn by their weights like Get.
+// Like Get, it returns the same batch again while none of it is acked or queued again.
+func (c *Consumer) GetNewest(num int64) (PrioritizedMessages, error) {
+	b := c.broker
+	script := b.takeScript(claimNewestScript, popNewestScript)
+	return c.getWith(context.Background(), num, func(ctx context.Context, num int64) (PrioritizedMessages, error) {
+		return b.getLanes(ctx, num, func(ctx context.Context, id, delayedID string, num int64) (PrioritizedMessages, error) {
+			return b.getFrom(ctx, script, id, delayedID, num, noScoreLimit)
+		})
+	})
+}
+
+// GetAbovePriority gets bodies and priorities of messages whose priority is minPriority or higher.
+// Messages with lower priority are left in the queue.
+// Like Get, it returns the same batch again while none of it is acked or queued again.
+func (c *Consumer) GetAbovePriority(num int64, minPriority float64) (PrioritizedMessages, error) {
+	maxScore := strconv.FormatFloat(c.broker.score(minPriority), 'g', -1, 64)
+	return c.get(context.Background(), num, maxScore)
+}
+
+// GetFair gets bodies and priorities taking turns among producers tagged by PutFrom
+// so that a bursty producer doesn't take the whole batch. Untagged messages count as one producer.
+// Messages of each producer are in priority order, and only the head of the queue
+// up to ten times num is considered. It may return fewer messages while others are getting them.
+// Delayed messages which are ready are delivered and expired ones are removed as with Get.
+// With Config.Lanes, lanes are drawn by their weights like Get and producers take turns within each lane.
+// Like Get, it returns the same batch again while none of it is acked or queued again.
+func (c *Consumer) GetFair(num int64) (PrioritizedMessages, error) {
+	return c.getWith(context.Background(), num, c.broker.getFair)
+}
+
+func (c *Consumer) get(ctx context.Context, num int64, maxScore string) (messages PrioritizedMessages, err error) {
+	return c.getWith(ctx, num, func(ctx context.Context, num int64) (PrioritizedMessages, error) {
+		return c.broker.get(ctx, num, maxScore)
+	})
+}
+
+// getWith fetches new messages by fetch unless the last batch is still claimed
+func (c *Consumer) getWith(ctx context.Context, num int64, fetch func(ctx context.Context, num int64) (PrioritizedMessages, error)) (messages PrioritizedMessages, err error) {
+	if c.closed {
+		err = ErrClosed
+		return
+	}
+
+	if len(c.lastBatch) != 0 {
+		messages = c.lastBatch
+		return
+	}
+
+	messages, err = c.fetch(ctx, num, fetch)
+	if err != nil {
+		return
+	}
+
+	if c.broker.deliveryMode != AtMostOnce {
+		c.lastBatch = messages
+	}
+
+	return
+}
+
+// fetch claims new messages by fetch for the consumer
+func (c *Consumer) fetch(ctx context.Context, num int64, fetch func(ctx context.Context, num int64) (PrioritizedMessages, error)) (messages PrioritizedMessages, err error) {
+	if max := int64(c.broker.maxClaimed); max > 0 {
+		headroom := max - int64(len(c.notAckedMessages))
+		if num <= 0 {
+			// Claim all messages the consumer can still hold
+			num = headroom
+		}
+		if num <= 0 || num > headroom {
+			err = ErrClaimLimit
+			return
+		}
+	}
+
+	if max := c.broker.maxGetBatch; max > 0 && (num <= 0 || num > max) {
+		num = max
+	}
+
+	messages, err = fetch(ctx, num)
+	if err != nil {
+		return
+	}
+	if c.broker.deliveryMode == AtMostOnce {
+		// Popped messages are gone from redis, so they are returned even when ctx is done meanwhile
+		atomic.AddInt64(&c.broker.stats.Gotten, int64(len(messages)))
+		atomic.AddInt64(&c.broker.stats.Acked, int64(len(messages)))
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		// Put back messages claimed while ctx was being done since the caller doesn't take them
+		if unclaimErr := c.broker.unclaim(messages); unclaimErr != nil {
+			c.broker.logger.Printf("mq: failed to put back claimed messages of %s: %v", c.broker.id, unclaimErr)
+		}
+		messages = nil
+		return
+	}
+
+	c.notAckedMessages = append(c.notAckedMessages, messages...)
+	atomic.AddInt64(&c.broker.inFlight, int64(len(messages)))
+	atomic.AddInt64(&c.broker.stats.Gotten, int64(len(messages)))
+
+	return
+}
+
+// GetBatch claims num new messages as a batch identified by the returned ID
+// even while other batches are claimed, so that several batches can be processed at once.
+// A batch is settled by AckBatch or ReQueueBatch, and Ack and ReQueue settle all batches.
+func (c *Consumer) GetBatch(num int64) (batchID string, messages PrioritizedMessages, err error) {
+	if c.closed {
+		err = ErrClosed
+		return
+	}
+
+	messages, err = c.fetch(context.Background(), num, func(ctx context.Context, num int64) (PrioritizedMessages, error) {
+		return c.broker.get(ctx, num, noScoreLimit)
+	})
+	if err != nil || len(messages) == 0 || c.broker.deliveryMode == AtMostOnce {
+		return
+	}
+
+	c.batchSeq++
+	batchID = strconv.FormatInt(c.batchSeq, 10)
+	if c.batches == nil {
+		c.batches = make(map[string]PrioritizedMessages)
+	}
+	c.batches[batchID] = messages
+
+	return
+}
+
+// AckBatch acks messages of the batch gotten by GetBatch.
+// It does nothing if the batch is unknown or settled already.
+func (c *Consumer) AckBatch(batchID string) error {
+	return c.ack(c.claimed(c.batches[batchID]), false)
+}
+
+// ReQueueBatch queue messages of the batch gotten by GetBatch again.
+// It does nothing if the batch is unknown or settled already.
+func (c *Consumer) ReQueueBatch(batchID string) error {
+	return c.requeue(c.claimed(c.batches[batchID]), 0, false)
+}
+
+// Peek gets bodies and priorities of the head of the queue.
+// It returns ErrLanes with Config.Lanes.
+func (r *Reader) Peek(num int64) (PrioritizedMessages, error) {
+	return r.broker.peekHead(num)
+}
+
+// PeekRange gets count messages from offset of the queue.
+// Out of range offsets return no messages. It returns ErrLanes with Config.Lanes.
+func (r *Reader) PeekRange(offset, count int64) (PrioritizedMessages, error) {
+	return r.broker.peekRange(offset, count)
+}
+
+// Find scans the queue for messages whose bodies match like Consumer.Find
+func (r *Reader) Find(ctx context.Context, match func([]byte) bool, limit int) (PrioritizedMessages, error) {
+	return r.broker.find(ctx, match, limit)
+}
+
+// Len returns the number of messages waiting in the queue like MessageQueue.Len
+func (r *Reader) Len() (int64, error) {
+	return r.broker.len()
+}
+
+// Close queues messages claimed by the consumer again and stops it getting messages without closing the message queue.
+// Get returns ErrClosed after Close. Messages failed to be queued again stay claimed and the error is returned.
+func (c *Consumer) Close() error {
+	c.closed = true
+	return c.ReQueue()
+}
+
+// Pop removes and returns messages at the head of the queue atomically in the order of Get.
+// Popped messages are never claimed, so they need no Ack and are lost if processing them fails.
+// Lanes are drawn by their weights like Get.
+func (c *Consumer) Pop(num int64) (PrioritizedMessages, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	b := c.broker
+	if max := b.maxGetBatch; max > 0 && (num <= 0 || num > max) {
+		num = max
+	}
+
+	messages, err := b.getLanes(context.Background(), num, func(ctx context.Context, id, delayedID string, num int64) (PrioritizedMessages, error) {
+		return b.getFrom(ctx, popScript, id, delayedID, num, noScoreLimit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&b.stats.Gotten, int64(len(messages)))
+	atomic.AddInt64(&b.stats.Acked, int64(len(messages)))
+
+	return messages, nil
+}
+
+// HandleSignals returns a context derived from ctx which is cancelled on SIGINT or SIGTERM and a function
+// to be called after the loop using the consumer exits on the context. The function stops handling signals
+// and closes the consumer so that claimed messages are queued again, since the consumer is not safe for concurrent use.
+// Handlers are installed only until the function is called.
+func (c *Consumer) HandleSignals(ctx context.Context) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() error {
+		signal.Stop(sigC)
+		cancel()
+		return c.Close()
+	}
+}
+
+// GetIterator claims messages like Get and returns an iterator over them
+func (c *Consumer) GetIterator(num int64) (*MessageIterator, error) {
+	messages, err := c.Get(num)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessageIterator{
+		consumer: c,
+		messages: messages,
+	}, nil
+}
+
+// Next moves to the next message and reports whether there is one.
+// It returns false when the messages are exhausted or acking them failed with AckConsumed.
+func (it *MessageIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.AckConsumed {
+		if it.err = it.ackConsumed(); it.err != nil {
+			return false
+		}
+	}
+	if it.consumed >= len(it.messages) {
+		return false
+	}
+
+	it.consumed++
+	return true
+}
+
+// Message returns the current message moved to by Next
+func (it *MessageIterator) Message() PrioritizedMessage {
+	if it.consumed == 0 {
+		return PrioritizedMessage{}
+	}
+
+	return it.messages[it.consumed-1]
+}
+
+// Err returns the error stopping the iteration
+func (it *MessageIterator) Err() error {
+	return it.err
+}
+
+// Close acks messages consumed by Next and not acked yet.
+// Messages not consumed stay claimed by the consumer.
+func (it *MessageIterator) Close() error {
+	return it.ackConsumed()
+}
+
+func (it *MessageIterator) ackConsumed() error {
+	if it.acked == it.consumed {
+		return nil
+	}
+
+	err := it.consumer.AckMessages(it.messages[it.acked:it.consumed])
+	if err != nil {
+		return err
+	}
+
+	it.acked = it.consumed
+	return nil
+}
+
+// Peek gets bodies and priorities of the head of the queue without claiming them.
+// It returns ErrLanes with Config.Lanes.
+func (c *Consumer) Peek(num int64) (PrioritizedMessages, error) {
+	return c.broker.peekHead(num)
+}
+
+func (b *broker) peekHead(num int64) (PrioritizedMessages, error) {
+	if len(b.lanes) != 0 {
+		return nil, ErrLanes
+	}
+
+	return b.peek(b.id, 0, num-1)
+}
+
+// Find scans the queue for messages whose bodies match without claiming them.
+// It returns up to limit messages, or all of them when limit <= 0, in no particular order.
+// Messages moved during the scan may be missed or returned twice. Malformed members are skipped.
+func (c *Consumer) Find(ctx context.Context, match func([]byte) bool, limit int) (PrioritizedMessages, error) {
+	return c.broker.find(ctx, match, limit)
+}
+
+func (b *broker) find(ctx context.Context, match func([]byte) bool, limit int) (PrioritizedMessages, error) {
+	var found PrioritizedMessages
+	for _, id := range b.laneIDs() {
+		err := b.scan(ctx, id, func(m PrioritizedMessage) bool {
+			if match(m.GetBody()) {
+				found = append(found, m)
+			}
+			return limit <= 0 || len(found) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(found) >= limit {
+			break
+		}
+	}
+
+	return found, nil
+}
+
+// scan passes messages of key to fn with ZSCAN until fn returns false.
+// Malformed members are skipped.
+func (b *broker) scan(ctx context.Context, key string, fn func(PrioritizedMessage) bool) error {
+	var cursor uint64
+	for {
+		var vals []string
+		err := b.withContext(ctx, func(rc redisCmdable) error {
+			var err error
+			vals, cursor, err = rc.ZScan(key, cursor, "", scanCount).Result()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(vals); i += 2 {
+			score, err := strconv.ParseFloat(vals[i+1], 64)
+			if err != nil {
+				return err
+			}
+			m, err := b.decode(vals[i], b.priority(score))
+			if err != nil {
+				b.logger.Printf("mq: skipped malformed member %q of %s: %v", vals[i], key, err)
+				continue
+			}
+			if !fn(m) {
+				return nil
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// PeekTail gets bodies and priorities of the tail of the queue from the lowest priority without claiming them.
+// It helps to choose messages to drop when the queue is full. It returns ErrLanes with Config.Lanes.
+func (c *Consumer) PeekTail(num int64) (PrioritizedMessages, error) {
+	if len(c.broker.lanes) != 0 {
+		return nil, ErrLanes
+	}
+
+	return c.broker.peekTail(c.broker.id, 0, num-1)
+}
+
+// PeekRange gets count messages from offset of the queue without claiming them.
+// Out of range offsets return no messages. It returns ErrLanes with Config.Lanes.
+func (c *Consumer) PeekRange(offset, count int64) (PrioritizedMessages, error) {
+	return c.broker.peekRange(offset, count)
+}
+
+func (b *broker) peekRange(offset, count int64) (PrioritizedMessages, error) {
+	if len(b.lanes) != 0 {
+		return nil, ErrLanes
+	}
+	if offset < 0 || count <= 0 {
+		return nil, nil
+	}
+
+	return b.peek(b.id, offset, offset+count-1)
+}
+
+// UpdatePriority changes the priority of m which is still waiting in the queue.
+// With Config.Lanes, m stays in the lane holding it even if LaneSelector routes the new priority elsewhere.
+// It does nothing if m has already been claimed or removed.
+func (c *Consumer) UpdatePriority(m PrioritizedMessage, newPriority float64) error {
+	m.priority = newPriority
+
+	b := c.broker
+	z := b.convertToZ(m)
+	return b.withContext(context.Background(), func(rc redisCmdable) error {
+		return updateScript.Run(rc, b.laneIDs(), z.Score, z.Member).Err()
+	})
+}
+
+// GetBlocking gets bodies and priorities waiting until at least one message is available.
+// It returns an empty slice and ErrTimeout when timeout elapses.
+func (c *Consumer) GetBlocking(num int64, timeout time.Duration) (messages PrioritizedMessages, err error) {
+	return c.GetBlockingContext(context.Background(), num, timeout)
+}
+
+// GetBlockingContext is GetBlocking which returns ctx.Err() as soon as ctx is done while waiting for the next poll.
+// A command sent to redis is not aborted, so cancellation is noticed after it responds,
+// which can take up to Config.ReadTimeout.
+func (c *Consumer) GetBlockingContext(ctx context.Context, num int64, timeout time.Duration) (messages PrioritizedMessages, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		messages, err = c.GetContext(ctx, num)
+		if err != nil || len(messages) != 0 {
+			return
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			err = ErrTimeout
+			return
+		}
+		if wait > blockingPollInterval {
+			wait = blockingPollInterval
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+// GetWithBackoff gets bodies and priorities waiting until at least one message is available.
+// It polls redis with exponential backoff from min up to max while the queue is empty,
+// and each call starts from min again. It returns ctx.Err() as soon as ctx is done while waiting for the next poll
+// and after the command running otherwise like GetBlockingContext.
+func (c *Consumer) GetWithBackoff(ctx context.Context, num int64, min, max time.Duration) (messages PrioritizedMessages, err error) {
+	wait := min
+	for {
+		messages, err = c.GetContext(ctx, num)
+		if err != nil || len(messages) != 0 {
+			return
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		wait *= 2
+		if wait <= 0 || wait > max {
+			wait = max
+		}
+	}
+}
+
+// Notifications returns a channel signaled when messages may have been put into the queue
+// by clients with Config.PublishEvents. Signals are coalesced while nobody receives them,
+// so a receiver should get messages until the queue is empty.
+// The subscription reconnects on network errors and the channel is closed when ctx is done or the queue is closed.
+func (c *Consumer) Notifications(ctx context.Context) (<-chan struct{}, error) {
+	b := c.broker
+	s, ok := b.redisClient.(subscriber)
+	if !ok {
+		return nil, errors.New("Redis client doesn't support pub/sub")
+	}
+
+	var pubsub *redis.PubSub
+	err := b.withContext(ctx, func(rc redisCmdable) error {
+		var err error
+		pubsub, err = s.Subscribe(b.eventsID)
+		if err != nil {
+			return err
+		}
+		// Wait for the confirmation not to miss events published right after
+		_, err = pubsub.Receive()
+		if err != nil {
+			pubsub.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-b.quit:
+		}
+		pubsub.Close()
+	}()
+
+	notifyC := make(chan struct{}, 1)
+	go func() {
+		defer close(notifyC)
+
+		for {
+			// ReceiveMessage reconnects and subscribes again on network errors
+			_, err := pubsub.ReceiveMessage()
+			if err != nil {
+				if ctx.Err() != nil || b.isClosed() {
+					return
+				}
+				b.logger.Printf("mq: failed to receive events of %s: %v", b.id, err)
+
+				select {
+				case <-time.After(retryBackoff):
+					continue
+				case <-ctx.Done():
+					return
+				case <-b.quit:
+					return
+				}
+			}
+
+			select {
+			case notifyC <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return notifyC, nil
+}
+
+// Consume gets messages and passes them to handler until ctx is done.
+// Messages are acked when handler returns nil and queued again otherwise.
+// It returns ctx.Err() after cancellation or the first error from redis.
+// Cancellation aborts waiting for messages promptly, but a batch passed to handler is settled first
+// and a command sent to redis runs up to Config.ReadTimeout before cancellation is noticed.
+func (c *Consumer) Consume(ctx context.Context, num int64, handler func(PrioritizedMessages) error) error {
+	for {
+		messages, err := c.GetContext(ctx, num)
+		if err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			select {
+			case <-time.After(blockingPollInterval):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
 
+		if err := handler(messages); err != nil {
+			err = c.ReQueue()
+			if err != nil {
+				return err
+			}
+		} else {
+			err = c.Ack()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Drain gets and acks all messages batch by batch and emits them on the returned channel
+// until the queue is empty or ctx is done. The error channel reports a failure aborting the drain.
+// A batch interrupted by ctx is queued again, so its emitted messages may be delivered again.
+// The consumer must not be used by others until the message channel is closed.
+func (c *Consumer) Drain(ctx context.Context, batch int64) (<-chan PrioritizedMessage, <-chan error) {
+	messageC := make(chan PrioritizedMessage)
+	errC := make(chan error, 1)
+
+	go func() {
+		defer close(errC)
+		defer close(messageC)
+
+		for {
+			messages, err := c.GetContext(ctx, batch)
+			if err != nil {
+				errC <- err
+				return
+			}
+			if len(messages) == 0 {
+				return
+			}
+
+			for i := range messages {
+				select {
+				case messageC <- messages[i]:
+				case <-ctx.Done():
+					if err := c.ReQueue(); err != nil {
+						errC <- err
+						return
+					}
+					errC <- ctx.Err()
+					return
+				}
+			}
+
+			if err := c.Ack(); err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+
+	return messageC, errC
+}
+
+// Reset forgets messages claimed by the consumer without a round trip to redis.
+// They stay in the processing set until MessageQueue.Recover or Config.VisibilityTimeout queues them again.
+func (c *Consumer) Reset() {
+	atomic.AddInt64(&c.broker.inFlight, -int64(len(c.notAckedMessages)))
+	c.notAckedMessages = nil
+	c.lastBatch = nil
+	c.batches = nil
+}
+
+// Pending returns a copy of messages claimed by the consumer and not acked yet
+func (c *Consumer) Pending() PrioritizedMessages {
+	pending := make(PrioritizedMessages, len(c.notAckedMessages))
+	copy(pending, c.notAckedMessages)
+
+	return pending
+}
+
+// Ack acks all claimed messages.
+// It is idempotent and messages already removed from redis by others are acked without an error.
+func (c *Consumer) Ack() error {
+	return c.ack(c.notAckedMessages, false)
+}
+
+// AckMessage acks a single claimed message.
+// It does nothing if m is not claimed by the consumer.
+func (c *Consumer) AckMessage(m PrioritizedMessage) error {
+	return c.AckMessages(PrioritizedMessages{m})
+}
+
+// AckMessages acks claimed messages in ms and keeps the rest claimed.
+// Messages not claimed by the consumer are ignored.
+func (c *Consumer) AckMessages(ms PrioritizedMessages) error {
+	return c.ack(c.claimed(ms), false)
+}
+
+// claimed returns messages in ms which are claimed by the consumer
+func (c *Consumer) claimed(ms PrioritizedMessages) PrioritizedMessages {
+	var claimed PrioritizedMessages
+	for i := range ms {
+		if c.notAckedMessages.contains(ms[i].member) && !claimed.contains(ms[i].member) {
+			claimed = append(claimed, ms[i])
+		}
+	}
+
+	return claimed
+}
+
+// ack removes claimed messages. requeue tells they are going to be queued again.
+// It returns *AckError when only some of messages are removed.
+func (c *Consumer) ack(messages PrioritizedMessages, requeue bool) error {
+	_, err := c.ackWith(messages, requeue)
+	return err
+}
+
+// ackWith acks messages like ack and returns members which were not claimed in redis anymore,
+// e.g. recovered by MessageQueue.Recover
+func (c *Consumer) ackWith(messages PrioritizedMessages, requeue bool) (missing []string, err error) {
+	if len(messages) == 0 {
+		return
+	}
+
+	ca := &consumerAck{
+		key:       c.broker.processingID,
+		claimsKey: c.broker.claimsID,
+		members:   messages.getMembers(),
+		requeue:   requeue,
+		errC:      make(chan error, 1),
+	}
+	if c.broker.archiveSize > 0 && !requeue {
+		ca.archiveKey = c.broker.archiveID
+		ca.archiveSize = c.broker.archiveSize
+		for i := range messages {
+			// Keep priorities in the same format as delayed messages
+			z := c.broker.convertToZ(messages[i])
+			ca.archived = append(ca.archived, strconv.FormatFloat(z.Score, 'g', -1, 64)+delayedSeparator+messages[i].member)
+		}
+	}
+	err = c.broker.sendAck(ca)
+	if err != nil {
+		return
+	}
+
+	err = c.broker.waitAck(ca)
+	missing = ca.missing
+
+	if err != nil {
+		var failed PrioritizedMessages
+		for i := range messages {
+			for j := range ca.failed {
+				if messages[i].member == ca.failed[j] {
+					failed = append(failed, messages[i])
+					break
+				}
+			}
+		}
+		if len(failed) == len(messages) {
+			return
+		}
+
+		c.removeAcked(messages.exclude(failed), requeue)
+		err = &AckError{
+			Failed: failed,
+			Err:    err,
+		}
+		return
+	}
+
+	c.removeAcked(messages, requeue)
+	return
+}
+
+// removeAcked forgets messages removed from the processing set
+func (c *Consumer) removeAcked(messages PrioritizedMessages, requeue bool) {
+	c.notAckedMessages = c.notAckedMessages.exclude(messages)
+	c.lastBatch = nil
+	for id, batch := range c.batches {
+		if rest := batch.exclude(messages); len(rest) != 0 {
+			c.batches[id] = rest
+		} else {
+			delete(c.batches, id)
+		}
+	}
+	atomic.AddInt64(&c.broker.inFlight, -int64(len(messages)))
+	if !requeue {
+		atomic.AddInt64(&c.broker.stats.Acked, int64(len(messages)))
+	}
+}
+
+// ReQueue queue members again.
+// Messages which reach Config.MaxDeliveries are moved to the dead letter queue instead.
+func (c *Consumer) ReQueue() error {
+	return c.requeue(c.notAckedMessages, 0, false)
+}
+
+// ReQueueAfter queue members again but they are not delivered until delay elapses.
+// Zero delay is the same as ReQueue.
+func (c *Consumer) ReQueueAfter(delay time.Duration) error {
+	return c.requeue(c.notAckedMessages, delay, false)
+}
+
+// ReQueuePreserveOrder queue members again keeping their original positions
+// instead of putting them behind messages put since they were claimed.
+// Messages whose original members are still in the queue are not added twice.
+func (c *Consumer) ReQueuePreserveOrder() error {
+	return c.requeue(c.notAckedMessages, 0, true)
+}
+
+// ReQueueResetPriority queue members again at the priorities they were put with discarding priorities added since then.
+// Messages put at Config.DefaultPriority or by the first release are queued at Config.DefaultPriority.
+// DeliveryCount still grows, so Config.MaxDeliveries applies as with ReQueue.
+func (c *Consumer) ReQueueResetPriority() error {
+	return c.requeue(c.reprioritized(func(pm PrioritizedMessage) float64 {
+		base, err := strconv.ParseFloat(pm.message.Headers[basePriorityHeader], 64)
+		if err != nil {
+			return c.broker.cfg.DefaultPriority
+		}
+		return base
+	}), 0, false)
+}
+
+// ReQueueEscalate queue members again raising their priorities by step so that work failing persistently gets attention.
+// Step is subtracted instead when LowerIsHigher is set. A message escalated on every failure has
+// the priority it was put with raised by step times DeliveryCount minus one.
+func (c *Consumer) ReQueueEscalate(step float64) error {
+	if c.broker.lowerIsHigher {
+		step = -step
+	}
+
+	return c.requeue(c.reprioritized(func(pm PrioritizedMessage) float64 {
+		return pm.priority + step
+	}), 0, false)
+}
+
+// reprioritized returns copies of claimed messages with priorities converted by f
+func (c *Consumer) reprioritized(f func(PrioritizedMessage) float64) PrioritizedMessages {
+	messages := make(PrioritizedMessages, len(c.notAckedMessages))
+	for i := range c.notAckedMessages {
+		messages[i] = c.notAckedMessages[i]
+		messages[i].priority = f(messages[i])
+	}
+
+	return messages
+}
+
+// ReQueueMessages queue claimed messages in ms again and keeps the rest claimed to be acked later.
+// Messages not claimed by the consumer are ignored.
+func (c *Consumer) ReQueueMessages(ms PrioritizedMessages) error {
+	return c.requeue(c.claimed(ms), 0, false)
+}
+
+// Nack queues a single claimed message again for immediate redelivery.
+// It does nothing if m is not claimed by the consumer.
+func (c *Consumer) Nack(m PrioritizedMessage) error {
+	if !c.notAckedMessages.contains(m.member) {
+		return nil
+	}
+
+	return c.requeue(PrioritizedMessages{m}, 0, false)
+}
+
+func (c *Consumer) requeue(messages PrioritizedMessages, delay time.Duration, preserveOrder bool) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	// Copy not to change members of messages held by callers
+	originals := make(PrioritizedMessages, len(messages))
+	copy(originals, messages)
+	requeued := make(PrioritizedMessages, len(messages))
+	copy(requeued, messages)
+
+	err := c.broker.refreshMembers(requeued, preserveOrder)
+	if err != nil {
+		return err
+	}
+
+	// Ack at first and queue again only messages removed
+	missing, err := c.ackWith(messages, true)
+	ackErr, partial := err.(*AckError)
+	if err != nil && !partial {
+		return err
+	}
+
+	var alive, aliveOriginals, dead PrioritizedMessages
+	for i := range requeued {
+		if partial && ackErr.Failed.contains(originals[i].member) {
+			continue
+		}
+		// Recovered or acked by others already
+		if containsString(missing, originals[i].member) {
+			continue
+		}
+
+		if c.broker.isDead(requeued[i]) {
+			dead = append(dead, requeued[i])
+		} else {
+			alive = append(alive, requeued[i])
+			aliveOriginals = append(aliveOriginals, originals[i])
+		}
+	}
+
+	if len(alive) != 0 {
+		if preserveOrder {
+			err = c.broker.addUnlessPresent(context.Background(), alive, aliveOriginals)
+		} else if delay > 0 {
+			err = c.broker.addDelayed(context.Background(), c.broker.now().Add(delay), alive...)
+		} else {
+			err = c.broker.addToLanes(context.Background(), alive...)
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.broker.stats.ReQueued, int64(len(alive)))
+		if delay <= 0 {
+			c.broker.publishEvent(context.Background())
+		}
+	}
+
+	if len(dead) != 0 {
+		err = c.broker.add(context.Background(), c.broker.deadID, dead...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if partial {
+		return ackErr
+	}
 	return nil
 }
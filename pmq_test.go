@@ -1,10 +1,22 @@
 package mq
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/redis.v5"
 )
 
 func TestNewPriorityMQ(t *testing.T) {
@@ -25,28 +37,4199 @@ func TestNewPriorityMQ(t *testing.T) {
 				RedisDB:   redisDB,
 			})
 
+			Convey("Then connect error should be occurred with its cause", func() {
+				So(err, ShouldNotBeNil)
+				So(errors.Is(err, ErrConnect), ShouldBeTrue)
+
+				var connectErr *ConnectError
+				So(errors.As(err, &connectErr), ShouldBeTrue)
+				_, ok := connectErr.Unwrap().(net.Error)
+				So(ok, ShouldBeTrue)
+
+			})
+		})
+
+		Convey("When creating new mq with invalid sentinel addrs", func() {
+			_, err := NewPriorityMQ(Config{
+				Name:          queueID,
+				SentinelAddrs: []string{"invalid_host:26379"},
+				MasterName:    "mymaster",
+				RedisDB:       redisDB,
+			})
+
+			Convey("Then error should be occurred", func() {
+				So(err, ShouldNotBeNil)
+
+			})
+		})
+
+		Convey("When creating new mq with password for redis without requirepass", func() {
+			_, err := NewPriorityMQ(Config{
+				Name:          queueID,
+				RedisAddr:     redisAddr,
+				RedisDB:       redisDB,
+				RedisPassword: "invalid_password",
+			})
+
+			Convey("Then auth error should be occurred", func() {
+				So(err, ShouldNotBeNil)
+
+			})
+		})
+
+		Convey("When creating new mq with pool settings", func() {
+			mq, err := NewPriorityMQ(Config{
+				Name:         queueID,
+				RedisAddr:    redisAddr,
+				RedisDB:      redisDB,
+				PoolSize:     20,
+				DialTimeout:  time.Second,
+				ReadTimeout:  time.Second,
+				WriteTimeout: time.Second,
+			})
+			defer mq.Close()
+
+			Convey("Then a new one should be created", func() {
+				So(err, ShouldBeNil)
+				So(mq, ShouldNotBeNil)
+
+			})
+		})
+
+		Convey("When creating new mq", func() {
+			mq, err := NewPriorityMQ(cfg)
+			defer mq.Close()
+
+			Convey("Then a new one should be created", func() {
+				So(err, ShouldBeNil)
+				So(mq, ShouldNotBeNil)
+
+			})
+		})
+	})
+}
+
+func TestNewPriorityMQWithClient(t *testing.T) {
+	Convey("Given redis client", t, func() {
+		queueID := "test_with_client_mq"
+		client := redis.NewClient(&redis.Options{
+			Addr: "localhost:6379",
+			DB:   1,
+		})
+		defer client.Close()
+
+		Convey("When creating new mq with the client and closing it", func() {
+			mq, err := NewPriorityMQWithClient(queueID, client)
+			So(err, ShouldBeNil)
+
+			putErr := mq.Put([]byte("with_client_data"), 0)
+			l, _ := mq.Len()
+			mq.Purge()
+			mq.Close()
+
+			Convey("Then the client should be used and left open", func() {
+				So(putErr, ShouldBeNil)
+				So(l, ShouldEqual, 1)
+				So(client.Ping().Err(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestConfig_KeyPrefix(t *testing.T) {
+	Convey("Given config with key prefix", t, func() {
+		queueID := "test_key_prefix_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			KeyPrefix: "test_ns",
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("key_prefix_data_"+num), 0)
+		}
+
+		Convey("When get and requeue data", func() {
+			c.Get(5)
+			err := c.ReQueue()
+
+			Convey("Then prefixed keys should be used", func() {
+				So(err, ShouldBeNil)
+
+				res := mq.broker.redisClient.ZRange("test_ns:"+queueID, 0, -1)
+				So(len(res.Val()), ShouldEqual, 10)
+
+				res = mq.broker.redisClient.ZRange(queueID, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+
+				res = mq.broker.redisClient.ZRange("test_ns:"+queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConfig_ClusterAddrs(t *testing.T) {
+	Convey("Given config for cluster", t, func() {
+		cfg := Config{
+			Name:         "test_cluster_mq",
+			ClusterAddrs: []string{"localhost:7000"},
+		}
+
+		Convey("When getting the key without prefix", func() {
+			key := cfg.key()
+
+			Convey("Then it should be hash tagged", func() {
+				So(key, ShouldEqual, "{test_cluster_mq}")
+			})
+		})
+
+		Convey("When getting the key with prefix", func() {
+			cfg.KeyPrefix = "test_ns"
+			key := cfg.key()
+
+			Convey("Then the whole key should be hash tagged", func() {
+				So(key, ShouldEqual, "{test_ns:test_cluster_mq}")
+			})
+		})
+
+		Convey("When getting the key with hash tagged prefix", func() {
+			cfg.KeyPrefix = "{test_ns}"
+			key := cfg.key()
+
+			Convey("Then the hash tag of the prefix should be kept", func() {
+				So(key, ShouldEqual, "{test_ns}:test_cluster_mq")
+			})
+		})
+
+		Convey("When getting the key out of cluster mode", func() {
+			cfg.ClusterAddrs = nil
+			key := cfg.key()
+
+			Convey("Then it should not be hash tagged", func() {
+				So(key, ShouldEqual, "test_cluster_mq")
+			})
+		})
+
+		Convey("When creating new mq with invalid cluster addrs", func() {
+			_, err := NewPriorityMQ(Config{
+				Name:         "test_cluster_mq",
+				ClusterAddrs: []string{"invalid_host:7000"},
+			})
+
 			Convey("Then error should be occurred", func() {
 				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestConfig_AgingRate(t *testing.T) {
+	Convey("Given config with aging rate", t, func() {
+		queueID := "test_aging_rate_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:          queueID,
+			RedisAddr:     redisAddr,
+			RedisDB:       redisDB,
+			AgingRate:     100,
+			AgingInterval: 100 * time.Millisecond,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When a low priority message waits long enough", func() {
+			mq.Put([]byte("old_low_priority"), 0)
+			time.Sleep(350 * time.Millisecond)
+			mq.Put([]byte("new_high_priority"), 10)
+
+			Convey("Then it should be delivered before a newer high priority one", func() {
+				messages, err := c.Get(2)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "old_low_priority")
+				So(messages[0].GetPriority(), ShouldBeGreaterThan, 10)
+			})
+		})
+
+		Convey("When another queue ages the same messages", func() {
+			other, _ := NewPriorityMQ(cfg)
+			defer other.Close()
+
+			mq.Put([]byte("old_low_priority"), 0)
+			time.Sleep(350 * time.Millisecond)
+
+			Convey("Then they should be aged only once", func() {
+				messages, err := c.Get(1)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(messages[0].GetPriority(), ShouldBeGreaterThan, 10)
+				So(messages[0].GetPriority(), ShouldBeLessThan, 50)
+			})
+		})
+	})
+}
+
+func TestConfig_PriorityDecay(t *testing.T) {
+	Convey("Given config with priority decay", t, func() {
+		queueID := "test_priority_decay_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:          queueID,
+			RedisAddr:     redisAddr,
+			RedisDB:       redisDB,
+			AgingInterval: 100 * time.Millisecond,
+			PriorityDecay: func(age time.Duration, base float64) float64 {
+				return base - 100*age.Seconds()
+			},
+		}
+
+		Convey("When a high priority message waits long enough", func() {
+			mq, _ := NewPriorityMQ(cfg)
+			defer mq.Close()
+			defer mq.Purge()
+
+			mq.Put([]byte("old_high_priority"), 10)
+			time.Sleep(350 * time.Millisecond)
+			mq.Put([]byte("new_low_priority"), 5)
+
+			Convey("Then it should be delivered after a newer low priority one", func() {
+				messages, err := mq.GetConsumer().Get(2)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "new_low_priority")
+				So(messages[1].GetPriority(), ShouldBeLessThan, 5)
+			})
+		})
+
+		Convey("When a decayed message is queued again", func() {
+			mq, _ := NewPriorityMQ(cfg)
+			defer mq.Close()
+			defer mq.Purge()
+
+			c := mq.GetConsumer()
+			mq.Put([]byte("requeued_high_priority"), 10)
+			time.Sleep(250 * time.Millisecond)
+			c.Get(1)
+			c.ReQueue()
+			time.Sleep(250 * time.Millisecond)
+
+			Convey("Then it should decay from the first put", func() {
+				messages, err := c.Get(1)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(messages[0].GetPriority(), ShouldBeLessThan, -20)
+				So(messages[0].GetPriority(), ShouldBeGreaterThan, -60)
+			})
+		})
+
+		Convey("When aging is set as well", func() {
+			cfg.AgingRate = 1
+			_, err := NewPriorityMQ(cfg)
+
+			Convey("Then ErrDecayWithAging should be returned", func() {
+				So(err, ShouldEqual, ErrDecayWithAging)
+			})
+		})
+	})
+}
+
+func TestConfig_LowerIsHigher(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_lower_is_higher_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+
+		put := func(mq *MessageQueue) {
+			mq.Put([]byte("lower_is_higher_data_000"), 5)
+			mq.Put([]byte("lower_is_higher_data_001"), -1)
+			mq.Put([]byte("lower_is_higher_data_002"), 10)
+		}
+
+		Convey("When lower priority is higher", func() {
+			mq, _ := NewPriorityMQ(Config{
+				Name:          queueID,
+				RedisAddr:     redisAddr,
+				RedisDB:       redisDB,
+				LowerIsHigher: true,
+			})
+			defer mq.Close()
+			defer mq.Purge()
+
+			put(mq)
+			messages, err := mq.GetConsumer().Get(3)
+
+			Convey("Then messages should be gotten in ascending order of priority", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[0].GetBody()), ShouldEqual, "lower_is_higher_data_001")
+				So(messages[0].GetPriority(), ShouldEqual, -1)
+				So(messages[1].GetPriority(), ShouldEqual, 5)
+				So(messages[2].GetPriority(), ShouldEqual, 10)
+			})
+		})
+
+		Convey("When higher priority is higher", func() {
+			mq, _ := NewPriorityMQ(Config{
+				Name:      queueID,
+				RedisAddr: redisAddr,
+				RedisDB:   redisDB,
+			})
+			defer mq.Close()
+			defer mq.Purge()
+
+			put(mq)
+			messages, err := mq.GetConsumer().Get(3)
+
+			Convey("Then messages should be gotten in descending order of priority", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[0].GetBody()), ShouldEqual, "lower_is_higher_data_002")
+				So(messages[0].GetPriority(), ShouldEqual, 10)
+				So(messages[1].GetPriority(), ShouldEqual, 5)
+				So(messages[2].GetPriority(), ShouldEqual, -1)
+			})
+		})
+	})
+}
+
+func TestConfig_MaxClaimed(t *testing.T) {
+	Convey("Given config with max claimed", t, func() {
+		queueID := "test_max_claimed_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:       queueID,
+			RedisAddr:  redisAddr,
+			RedisDB:    redisDB,
+			MaxClaimed: 5,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("max_claimed_data_"+num), 0)
+		}
+
+		Convey("When getting more than max claimed", func() {
+			messages, err := c.Get(10)
+
+			Convey("Then nothing should be claimed", func() {
+				So(err, ShouldEqual, ErrClaimLimit)
+				So(len(messages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+			})
+		})
+
+		Convey("When getting within max claimed", func() {
+			messages, err := c.Get(5)
+
+			Convey("Then messages should be claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 5)
+			})
+		})
+
+		Convey("When getting all messages", func() {
+			c.GetBatch(2)
+			messages, err := c.Get(0)
+
+			Convey("Then as many as the consumer can still hold should be claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+
+				_, _, err = c.GetBatch(0)
+				So(err, ShouldEqual, ErrClaimLimit)
+			})
+		})
+	})
+}
+
+func TestConfig_VisibilityTimeout(t *testing.T) {
+	Convey("Given config with visibility timeout", t, func() {
+		queueID := "test_visibility_timeout_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:              queueID,
+			RedisAddr:         redisAddr,
+			RedisDB:           redisDB,
+			VisibilityTimeout: 100 * time.Millisecond,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		mq.Put([]byte("visibility_timeout_data"), 0)
+
+		Convey("When a consumer is dropped without Ack", func() {
+			mq.GetConsumer().Get(1)
+			time.Sleep(300 * time.Millisecond)
+
+			Convey("Then the message should be queued again", func() {
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+
+				claimed, _ := mq.broker.redisClient.ZCard(queueID + processingSuffix).Result()
+				So(claimed, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConfig_MaxGetBatch(t *testing.T) {
+	Convey("Given config with max get batch", t, func() {
+		queueID := "test_max_get_batch_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:        queueID,
+			RedisAddr:   redisAddr,
+			RedisDB:     redisDB,
+			MaxGetBatch: 3,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		for i := 0; i < 5; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("max_get_batch_data_"+num), 0)
+		}
+
+		Convey("When getting more than max get batch", func() {
+			messages, err := mq.GetConsumer().Get(10)
+
+			Convey("Then max get batch messages should be claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When getting all", func() {
+			messages, err := mq.GetConsumer().Get(0)
+
+			Convey("Then max get batch messages should be claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestConfig_MaxLen(t *testing.T) {
+	Convey("Given config with max len", t, func() {
+		queueID := "test_max_len_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			MaxLen:    3,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages over max len", func() {
+			err1 := mq.Put([]byte("max_len_data_000"), 0)
+			err2 := mq.PutBatch([][]byte{[]byte("max_len_data_001"), []byte("max_len_data_002")}, []float64{0, 0})
+			err3 := mq.Put([]byte("max_len_data_003"), 0)
+			err4 := mq.PutBatch([][]byte{[]byte("max_len_data_004"), []byte("max_len_data_005")}, []float64{0, 0})
+
+			Convey("Then messages over max len should be rejected", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(err3, ShouldEqual, ErrQueueFull)
+				So(err4, ShouldEqual, ErrQueueFull)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 3)
+				So(mq.Stats().Put, ShouldEqual, 3)
+			})
+		})
+	})
+}
+
+func TestConfig_Lanes(t *testing.T) {
+	Convey("Given config with weighted lanes", t, func() {
+		queueID := "test_lanes_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			Lanes:     []LaneConfig{{Name: "high", Weight: 3}, {Name: "low", Weight: 1}},
+			LaneSelector: func(body []byte, priority float64) string {
+				if priority >= 10 {
+					return "high"
+				}
+				return "low"
+			},
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 4; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("lanes_high_data_"+num), 10)
+			mq.Put([]byte("lanes_low_data_"+num), 0)
+		}
+
+		Convey("When getting messages", func() {
+			messages, err := c.Get(4)
+
+			Convey("Then they should be drawn from lanes by weight", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 4)
+				So(string(messages[0].GetBody()), ShouldEqual, "lanes_high_data_000")
+				So(string(messages[2].GetBody()), ShouldEqual, "lanes_high_data_002")
+				So(string(messages[3].GetBody()), ShouldEqual, "lanes_low_data_000")
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 4)
+			})
+		})
+
+		Convey("When a lane runs out", func() {
+			c.Get(4)
+			c.Ack()
+			messages, err := c.Get(8)
+
+			Convey("Then its share should be drawn from the other lanes", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 4)
+				So(string(messages[0].GetBody()), ShouldEqual, "lanes_high_data_003")
+				So(string(messages[3].GetBody()), ShouldEqual, "lanes_low_data_003")
+			})
+		})
+
+		Convey("When requeueing messages", func() {
+			c.Get(4)
+			err := c.ReQueue()
+
+			Convey("Then they should go back to their lanes", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 8)
+
+				high, _ := mq.broker.peek(queueID, 0, -1)
+				So(len(high), ShouldEqual, 4)
+			})
+		})
+
+		Convey("When getting the newest messages", func() {
+			messages, err := c.GetNewest(4)
+
+			Convey("Then they should be drawn from lanes by weight", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 4)
+				So(string(messages[0].GetBody()), ShouldEqual, "lanes_high_data_003")
+				So(string(messages[3].GetBody()), ShouldEqual, "lanes_low_data_003")
+			})
+		})
+
+		Convey("When popping messages", func() {
+			messages, err := c.Pop(4)
+
+			Convey("Then they should be drawn from lanes by weight", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 4)
+				So(string(messages[3].GetBody()), ShouldEqual, "lanes_low_data_000")
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 4)
+			})
+		})
+
+		Convey("When updating the priority of a message in a lane other than the first one", func() {
+			low, _ := mq.broker.peek(queueID+laneSuffix+"low", 0, 0)
+			err := c.UpdatePriority(low[0], 5)
+			updated, _ := mq.broker.peek(queueID+laneSuffix+"low", 0, 0)
+
+			Convey("Then it should be updated in its lane", func() {
+				So(err, ShouldBeNil)
+				So(string(updated[0].GetBody()), ShouldEqual, "lanes_low_data_000")
+				So(updated[0].GetPriority(), ShouldEqual, 5)
+			})
+		})
+
+		Convey("When peeking messages", func() {
+			_, err := c.Peek(10)
+			_, tailErr := c.PeekTail(10)
+			_, rangeErr := mq.GetReader().PeekRange(0, 10)
+
+			Convey("Then ErrLanes should be returned", func() {
+				So(err, ShouldEqual, ErrLanes)
+				So(tailErr, ShouldEqual, ErrLanes)
+				So(rangeErr, ShouldEqual, ErrLanes)
+			})
+		})
+
+		Convey("When putting a batch into lanes one of which is full", func() {
+			cfg.MaxLen = 5
+			bounded, _ := NewPriorityMQ(cfg)
+			defer bounded.Close()
+
+			err := bounded.PutBatch([][]byte{
+				[]byte("lanes_high_data_004"),
+				[]byte("lanes_low_data_004"),
+				[]byte("lanes_low_data_005"),
+			}, []float64{10, 0, 0})
+
+			Convey("Then none of the batch should be put", func() {
+				So(err, ShouldEqual, ErrQueueFull)
+
+				l, _ := bounded.Len()
+				So(l, ShouldEqual, 8)
+			})
+		})
+	})
+}
+
+func TestConfig_MaxMessageBytes(t *testing.T) {
+	Convey("Given config with max message bytes", t, func() {
+		queueID := "test_max_message_bytes_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:            queueID,
+			RedisAddr:       redisAddr,
+			RedisDB:         redisDB,
+			MaxMessageBytes: 64,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages over max message bytes", func() {
+			large := make([]byte, 64)
+			err1 := mq.Put([]byte("max_message_bytes_data_000"), 0)
+			err2 := mq.Put(large, 0)
+			err3 := mq.PutBatch([][]byte{[]byte("max_message_bytes_data_001"), large}, []float64{0, 0})
+
+			Convey("Then they should be rejected counting the prefix", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldEqual, ErrMessageTooLarge)
+				So(err3, ShouldEqual, ErrMessageTooLarge)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestConfig_DeliveryMode(t *testing.T) {
+	Convey("Given config with at most once delivery", t, func() {
+		queueID := "test_delivery_mode_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:         queueID,
+			RedisAddr:    redisAddr,
+			RedisDB:      redisDB,
+			DeliveryMode: AtMostOnce,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("delivery_mode_data_"+num), 0)
+		}
+
+		Convey("When get and requeue messages", func() {
+			messages1, err := c.Get(5)
+			requeueErr := c.ReQueue()
+			messages2, _ := c.Get(10)
+
+			Convey("Then they should be removed on get and never delivered again", func() {
+				So(err, ShouldBeNil)
+				So(len(messages1), ShouldEqual, 5)
+				So(requeueErr, ShouldBeNil)
+				So(len(messages2), ShouldEqual, 5)
+				So(string(messages2[0].GetBody()), ShouldEqual, "delivery_mode_data_005")
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When a consumer gets messages and drops them without acking", func() {
+			messages1, err := c.Get(3)
+			c.notAckedMessages = nil
+			recovered, recoverErr := mq.Recover(0)
+			messages2, _ := mq.GetConsumer().Get(10)
+
+			Convey("Then they should never be delivered again", func() {
+				So(err, ShouldBeNil)
+				So(len(messages1), ShouldEqual, 3)
+				So(recoverErr, ShouldBeNil)
+				So(recovered, ShouldEqual, 0)
+				So(len(messages2), ShouldEqual, 7)
+				So(string(messages2[0].GetBody()), ShouldEqual, "delivery_mode_data_003")
+			})
+		})
+	})
+}
+
+func TestConfig_TLSConfig(t *testing.T) {
+	// Needs a TLS-enabled redis like stunnel in front of redis-server
+	redisAddr := os.Getenv("PMQ_TEST_TLS_REDIS_ADDR")
+	if redisAddr == "" {
+		t.Skip("PMQ_TEST_TLS_REDIS_ADDR is not set")
+	}
+
+	Convey("Given config with TLS config", t, func() {
+		queueID := "test_tls_mq"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+
+		Convey("When creating new mq and putting a message", func() {
+			mq, err := NewPriorityMQ(cfg)
+			So(err, ShouldBeNil)
+			defer mq.Close()
+			defer mq.Purge()
+
+			err = mq.Put([]byte("tls_data"), 0)
+
+			Convey("Then the message should be put over TLS", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+type testLogger struct {
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+}
+
+func TestConfig_Logger(t *testing.T) {
+	Convey("Given config with logger", t, func() {
+		queueID := "test_logger_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		logger := &testLogger{}
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			Logger:    logger,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When ack fails in the ack listener", func() {
+			mq.Put([]byte("logger_data"), 0)
+			c.Get(1)
+			// Break the processing set so that ZREM fails
+			mq.broker.redisClient.Del(queueID + processingSuffix)
+			mq.RedisClient().Set(queueID+processingSuffix, "broken", 0)
+			err := c.Ack()
+
+			Convey("Then the failure should be logged", func() {
+				So(err, ShouldNotBeNil)
+				So(len(logger.logs), ShouldEqual, 1)
+				So(logger.logs[0], ShouldStartWith, "mq: failed to ack 1 members of "+queueID)
+			})
+		})
+	})
+}
+
+func TestConfig_AckWorkers(t *testing.T) {
+	Convey("Given config with ack workers and saved data", t, func() {
+		queueID := "test_ack_workers_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:       queueID,
+			RedisAddr:  redisAddr,
+			RedisDB:    redisDB,
+			AckWorkers: 4,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("ack_workers_data_"+num), 0)
+		}
+
+		Convey("When consumers ack concurrently", func() {
+			errC := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				go func(c *Consumer) {
+					c.Get(10)
+					errC <- c.Ack()
+				}(mq.GetConsumer())
+			}
+
+			var errs []error
+			for i := 0; i < 10; i++ {
+				if err := <-errC; err != nil {
+					errs = append(errs, err)
+				}
+			}
+
+			Convey("Then all messages should be acked", func() {
+				So(len(errs), ShouldEqual, 0)
+				So(mq.Stats().Acked, ShouldEqual, 100)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConfig_HealthCheckInterval(t *testing.T) {
+	Convey("Given config with health check", t, func() {
+		queueID := "test_health_check_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:                queueID,
+			RedisAddr:           redisAddr,
+			RedisDB:             redisDB,
+			HealthCheckInterval: 50 * time.Millisecond,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When redis is reachable", func() {
+			time.Sleep(100 * time.Millisecond)
+			err := mq.Put([]byte("health_check_data"), 0)
+
+			Convey("Then operations should succeed", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the health check has failed", func() {
+			atomic.StoreInt32(mq.broker.connected, 0)
+			putErr := mq.Put([]byte("health_check_data"), 0)
+			_, getErr := mq.GetConsumer().Get(1)
+
+			time.Sleep(100 * time.Millisecond)
+			recoveredErr := mq.Put([]byte("health_check_data"), 0)
+
+			Convey("Then ErrNotConnected should be returned until the next check succeeds", func() {
+				So(putErr, ShouldEqual, ErrNotConnected)
+				So(getErr, ShouldEqual, ErrNotConnected)
+				So(recoveredErr, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestConfig_OnConnect(t *testing.T) {
+	Convey("Given config with connection hooks", t, func() {
+		queueID := "test_on_connect_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		var connects, disconnects int32
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			OnConnect: func() {
+				atomic.AddInt32(&connects, 1)
+			},
+			OnDisconnect: func(error) {
+				atomic.AddInt32(&disconnects, 1)
+			},
+			HealthCheckInterval: 50 * time.Millisecond,
+		}
+
+		Convey("When creating mq", func() {
+			mq, err := NewPriorityMQ(cfg)
+			defer mq.Close()
+
+			time.Sleep(100 * time.Millisecond)
+
+			Convey("Then OnConnect should be called and OnDisconnect should not", func() {
+				So(err, ShouldBeNil)
+				So(atomic.LoadInt32(&connects), ShouldBeGreaterThan, 0)
+				So(atomic.LoadInt32(&disconnects), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConfig_CloseTimeout(t *testing.T) {
+	Convey("Given config with close timeout", t, func() {
+		queueID := "test_close_timeout_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:         queueID,
+			RedisAddr:    redisAddr,
+			RedisDB:      redisDB,
+			CloseTimeout: 100 * time.Millisecond,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+
+		Convey("When closing while a background loop is stuck", func() {
+			// Simulate a loop waiting for unresponsive redis
+			mq.broker.workers.Add(1)
+			defer mq.broker.workers.Done()
+
+			start := time.Now()
+			mq.Close()
+			elapsed := time.Since(start)
+
+			Convey("Then it should return after the timeout", func() {
+				So(elapsed, ShouldBeGreaterThanOrEqualTo, 100*time.Millisecond)
+				So(elapsed, ShouldBeLessThan, time.Second)
+				So(mq.Ping(), ShouldEqual, ErrClosed)
+			})
+		})
+	})
+}
+
+func TestConfig_MaxRetries(t *testing.T) {
+	Convey("Given config with max retries", t, func() {
+		queueID := "test_max_retries_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:       queueID,
+			RedisAddr:  redisAddr,
+			RedisDB:    redisDB,
+			MaxRetries: 3,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When the connections are killed by redis", func() {
+			mq.Put([]byte("max_retries_data_000"), 0)
+
+			rc := redis.NewClient(&redis.Options{Addr: redisAddr, DB: redisDB})
+			defer rc.Close()
+			rc.Process(redis.NewCmd("client", "kill", "type", "normal"))
+
+			err := mq.Put([]byte("max_retries_data_001"), 0)
+
+			Convey("Then put should succeed after reconnect", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+// flakyClient fails ZAdd with err the first failures times
+type flakyClient struct {
+	redisCmdable
+	failures int
+	err      error
+	calls    int
+}
+
+func (c *flakyClient) Ping() *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
+
+func (c *flakyClient) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	c.calls++
+	if c.calls <= c.failures {
+		return redis.NewIntResult(0, c.err)
+	}
+	return redis.NewIntResult(int64(len(members)), nil)
+}
+
+func TestBroker_put_Retry(t *testing.T) {
+	Convey("Given broker with a flaky client", t, func() {
+		refused := &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}
+		newFlakyBroker := func(rc *flakyClient) *broker {
+			return newBroker(Config{Name: "test_put_retry_mq", MaxRetries: 3}, &broker{
+				redisClient: rc,
+				quit:        make(chan struct{}),
+			})
+		}
+
+		Convey("When transient errors occur within the retry budget", func() {
+			rc := &flakyClient{failures: 2, err: refused}
+			b := newFlakyBroker(rc)
+			m, _ := b.newMessage([]byte("put_retry_data"), 0, 0)
+			err := b.put(context.Background(), m)
+
+			Convey("Then put should succeed eventually", func() {
+				So(err, ShouldBeNil)
+				So(rc.calls, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When transient errors exceed the retry budget", func() {
+			rc := &flakyClient{failures: 10, err: refused}
+			b := newFlakyBroker(rc)
+			m, _ := b.newMessage([]byte("put_retry_data"), 0, 0)
+			err := b.put(context.Background(), m)
+
+			Convey("Then the last error should be returned", func() {
+				So(err, ShouldEqual, refused)
+				So(rc.calls, ShouldEqual, 4)
+			})
+		})
+
+		Convey("When a non transient error occurs", func() {
+			wrongType := errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+			rc := &flakyClient{failures: 1, err: wrongType}
+			b := newFlakyBroker(rc)
+			m, _ := b.newMessage([]byte("put_retry_data"), 0, 0)
+			err := b.put(context.Background(), m)
+
+			Convey("Then it should not be retried", func() {
+				So(err, ShouldEqual, wrongType)
+				So(rc.calls, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+// memoryClient keeps sorted sets in memory to test putting without redis.
+// Only scores are kept since members are not ordered. Commands not implemented here,
+// including the scripts and pipelines consumers use, panic on the nil redisCmdable.
+type memoryClient struct {
+	redisCmdable
+	sets map[string]map[string]float64
+}
+
+func (c *memoryClient) Ping() *redis.StatusCmd {
+	return redis.NewStatusResult("PONG", nil)
+}
+
+func (c *memoryClient) ZAdd(key string, members ...redis.Z) *redis.IntCmd {
+	set, ok := c.sets[key]
+	if !ok {
+		set = make(map[string]float64)
+		c.sets[key] = set
+	}
+
+	var added int64
+	for _, z := range members {
+		member := z.Member.(string)
+		if _, ok := set[member]; !ok {
+			added++
+		}
+		set[member] = z.Score
+	}
+	return redis.NewIntResult(added, nil)
+}
+
+func (c *memoryClient) ZCard(key string) *redis.IntCmd {
+	return redis.NewIntResult(int64(len(c.sets[key])), nil)
+}
+
+func (c *memoryClient) Del(keys ...string) *redis.IntCmd {
+	var deleted int64
+	for _, key := range keys {
+		if _, ok := c.sets[key]; ok {
+			delete(c.sets, key)
+			deleted++
+		}
+	}
+	return redis.NewIntResult(deleted, nil)
+}
+
+func TestMessageQueue_InMemoryClient(t *testing.T) {
+	Convey("Given mq on an in-memory client", t, func() {
+		rc := &memoryClient{sets: make(map[string]map[string]float64)}
+		mq := &MessageQueue{
+			broker: newBroker(Config{Name: "test_in_memory_mq"}, &broker{
+				redisClient: rc,
+				quit:        make(chan struct{}),
+			}),
+		}
+
+		Convey("When putting and purging data", func() {
+			putErr := mq.Put([]byte("in_memory_data_000"), 0)
+			mq.Put([]byte("in_memory_data_001"), 1)
+			put, lenErr := mq.Len()
+			purgeErr := mq.Purge()
+			purged, _ := mq.Len()
+
+			Convey("Then the client should be used without redis", func() {
+				So(putErr, ShouldBeNil)
+				So(lenErr, ShouldBeNil)
+				So(put, ShouldEqual, 2)
+				So(purgeErr, ShouldBeNil)
+				So(purged, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestIsConnError(t *testing.T) {
+	Convey("Given errors", t, func() {
+		Convey("When checking connection errors", func() {
+			Convey("Then only connection level errors should be reported", func() {
+				So(isConnError(nil), ShouldBeFalse)
+				So(isConnError(io.EOF), ShouldBeTrue)
+				So(isConnError(&net.OpError{Op: "dial", Err: fmt.Errorf("refused")}), ShouldBeTrue)
+				So(isConnError(fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")), ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestConfig_Now(t *testing.T) {
+	Convey("Given config with a frozen clock", t, func() {
+		queueID := "test_now_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		now := time.Unix(1479459537, 280998000)
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			Now: func() time.Time {
+				return now
+			},
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages", func() {
+			mq.Put([]byte("now_data_000"), 0)
+			mq.Put([]byte("now_data_001"), 0)
+			mq.PutDelayed([]byte("now_data_002"), 0, time.Second)
+
+			Convey("Then they should be stamped and scheduled by the clock", func() {
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				So(res.Val(), ShouldResemble, []string{
+					"00001479459537280998.0000.0:now_data_000",
+					"00001479459537280998.0001.0:now_data_001",
+				})
+
+				messages, _ := mq.GetConsumer().Get(10)
+				So(len(messages), ShouldEqual, 2)
+				So(messages[0].EnqueuedAt().Equal(now), ShouldBeTrue)
+
+				now = now.Add(time.Second)
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+				messages, _ = mq.GetConsumer().Get(10)
+				So(len(messages), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestBroker_stamp(t *testing.T) {
+	Convey("Given broker", t, func() {
+		b := &broker{
+			codec: PrefixCodec{},
+			now:   time.Now,
+		}
+
+		Convey("When stamping messages in a burst", func() {
+			var members []string
+			for i := 0; i < 3*seqModulo; i++ {
+				m, _ := b.newMessage([]byte("stamp_data"), 0, 0)
+				members = append(members, m.member)
+			}
+
+			Convey("Then members should be sorted in the stamped order", func() {
+				for i := 1; i < len(members); i++ {
+					So(members[i-1] < members[i], ShouldBeTrue)
+				}
+			})
+		})
+
+		Convey("When the clock goes backwards", func() {
+			future := time.Now().Add(time.Hour).UnixNano() / 1000
+			b.lastTimestamp = future
+
+			m1, _ := b.newMessage([]byte("stamp_data_000"), 0, 0)
+			m2, _ := b.newMessage([]byte("stamp_data_001"), 0, 0)
+
+			Convey("Then members should still be sorted in the stamped order", func() {
+				So(m1.message.Timestamp, ShouldEqual, future)
+				So(m1.member < m2.member, ShouldBeTrue)
+			})
+		})
+
+		Convey("When brokers of different processes stamp the same body in the same microsecond", func() {
+			now := time.Unix(1479459537, 280998000)
+			cfg := Config{
+				Name: "test_stamp_mq",
+				Now: func() time.Time {
+					return now
+				},
+			}
+			b1 := newBroker(cfg, &broker{})
+			b2 := newBroker(cfg, &broker{})
+
+			m1, _ := b1.newMessage([]byte("stamp_data"), 0, 0)
+			m2, _ := b2.newMessage([]byte("stamp_data"), 0, 0)
+
+			Convey("Then members should be distinct", func() {
+				So(m1.message.Timestamp, ShouldEqual, m2.message.Timestamp)
+				So(m1.message.Seq, ShouldEqual, m2.message.Seq)
+				So(m1.member, ShouldNotEqual, m2.member)
+			})
+		})
+
+		Convey("When sorting messages with mixed priorities like redis", func() {
+			var zs []redis.Z
+			for i, p := range []float64{1, 3, 1, 2, 3} {
+				m, _ := b.newMessage([]byte(fmt.Sprintf("%d", 9-i)), p, 0)
+				zs = append(zs, b.convertToZ(m))
+			}
+			sort.Slice(zs, func(i, j int) bool {
+				if zs[i].Score != zs[j].Score {
+					return zs[i].Score < zs[j].Score
+				}
+				return zs[i].Member.(string) < zs[j].Member.(string)
+			})
+
+			Convey("Then they should be ordered by priority and then by the stamped order", func() {
+				var bodies []string
+				for i := range zs {
+					bodies = append(bodies, string(getBody(zs[i].Member.(string))))
+				}
+				So(bodies, ShouldResemble, []string{"8", "5", "6", "9", "7"})
+			})
+		})
+	})
+}
+
+func TestPrioritizedMessage_DeliveryCount(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_delivery_count_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+		mq.Put([]byte("delivery_count_data"), 0)
+
+		Convey("When getting the message repeatedly with requeue", func() {
+			first, _ := c.Get(1)
+			c.ReQueue()
+			second, _ := c.Get(1)
+			c.ReQueue()
+			third, _ := c.Get(1)
+
+			Convey("Then delivery count should be incremented each time", func() {
+				So(len(first), ShouldEqual, 1)
+				So(len(second), ShouldEqual, 1)
+				So(len(third), ShouldEqual, 1)
+				So(first[0].DeliveryCount(), ShouldEqual, 1)
+				So(second[0].DeliveryCount(), ShouldEqual, 2)
+				So(third[0].DeliveryCount(), ShouldEqual, 3)
+			})
+		})
+	})
+}
+
+func TestPrioritizedMessage_EnqueuedAt(t *testing.T) {
+	Convey("Given created mq", t, func() {
+		queueID := "test_enqueued_at_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When getting a put message", func() {
+			before := time.Now().Truncate(time.Microsecond)
+			mq.Put([]byte("enqueued_at_data"), 0)
+			after := time.Now()
+
+			messages, _ := mq.GetConsumer().Get(1)
+
+			Convey("Then it should return when the message was put", func() {
+				So(len(messages), ShouldEqual, 1)
+				So(messages[0].EnqueuedAt(), ShouldHappenOnOrBetween, before, after)
+			})
+		})
+
+		Convey("When the message has no timestamp", func() {
+			var m PrioritizedMessage
+
+			Convey("Then it should return zero time", func() {
+				So(m.EnqueuedAt().IsZero(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Put(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting a new message", func() {
+			body := "This is put data for tests"
+			err := mq.Put([]byte(body), 0)
+
+			Convey("Then the data should be put into target db", func() {
+				So(err, ShouldBeNil)
+
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				vals := res.Val()
+				So(len(vals), ShouldEqual, 1)
+				So(string(getBody(vals[0])), ShouldEqual, body)
+
+			})
+		})
+
+		Convey("When putting the same body twice back-to-back", func() {
+			body := "This is duplicated put data for tests"
+			err1 := mq.Put([]byte(body), 0)
+			err2 := mq.Put([]byte(body), 0)
+
+			Convey("Then both messages should be stored", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 2)
+
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutInt(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_int_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages with levels and priorities", func() {
+			err1 := mq.PutInt([]byte("put_int_data_000"), 1)
+			err2 := mq.Put([]byte("put_int_data_001"), 1.5)
+			err3 := mq.PutInt([]byte("put_int_data_002"), 1<<40)
+
+			Convey("Then levels should be kept exactly and ordered with priorities", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(err3, ShouldBeNil)
+
+				messages, _ := mq.GetConsumer().Get(10)
+				So(len(messages), ShouldEqual, 3)
+				So(messages[0].GetLevel(), ShouldEqual, 1<<40)
+				So(string(messages[1].GetBody()), ShouldEqual, "put_int_data_001")
+				So(messages[2].GetLevel(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutDefault(t *testing.T) {
+	Convey("Given config with default priority", t, func() {
+		queueID := "test_put_default_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:            queueID,
+			RedisAddr:       redisAddr,
+			RedisDB:         redisDB,
+			DefaultPriority: 5,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages with and without priority", func() {
+			err1 := mq.Put([]byte("put_default_data_000"), 10)
+			err2 := mq.PutDefault([]byte("put_default_data_001"))
+			err3 := mq.Put([]byte("put_default_data_002"), 0)
+
+			Convey("Then the default priority should be used", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(err3, ShouldBeNil)
+
+				messages, _ := mq.GetConsumer().Get(10)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[1].GetBody()), ShouldEqual, "put_default_data_001")
+				So(messages[1].GetPriority(), ShouldEqual, 5)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutContext(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_context_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting a new message with context", func() {
+			body := "This is put data for tests"
+			err := mq.PutContext(context.Background(), []byte(body), 0)
+
+			Convey("Then the data should be put into target db", func() {
+				So(err, ShouldBeNil)
+
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				vals := res.Val()
+				So(len(vals), ShouldEqual, 1)
+				So(string(getBody(vals[0])), ShouldEqual, body)
+
+			})
+		})
+
+		Convey("When putting a new message with cancelled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := mq.PutContext(ctx, []byte("This is put data for tests"), 0)
+
+			Convey("Then context error should be returned and nothing should be put", func() {
+				So(err, ShouldEqual, context.Canceled)
+
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutMessage(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_message_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting a new message", func() {
+			body := "This is put data for tests"
+			m, err := mq.PutMessage([]byte(body), 3)
+
+			Convey("Then the message put should be returned", func() {
+				So(err, ShouldBeNil)
+				So(string(m.GetBody()), ShouldEqual, body)
+				So(m.GetPriority(), ShouldEqual, 3)
+
+				messages, _ := mq.GetConsumer().Get(1)
+				So(len(messages), ShouldEqual, 1)
+				So(messages[0].member, ShouldEqual, m.member)
+				So(messages[0].ID(), ShouldEqual, m.ID())
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutWithTTL(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_with_ttl_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When putting messages with ttl", func() {
+			mq.PutWithTTL([]byte("expiring_data_000"), 1, 100*time.Millisecond)
+			mq.PutWithTTL([]byte("expiring_data_001"), 1, 100*time.Millisecond)
+			mq.PutWithTTL([]byte("living_data_000"), 1, time.Minute)
+			mq.Put([]byte("living_data_001"), 0)
+			mq.Put([]byte("living_data_002"), 0)
+			time.Sleep(200 * time.Millisecond)
+
+			Convey("Then expired messages should be skipped and removed", func() {
+				messages, err := c.Get(3)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[0].GetBody()), ShouldEqual, "living_data_000")
+				So(string(messages[1].GetBody()), ShouldEqual, "living_data_001")
+				So(string(messages[2].GetBody()), ShouldEqual, "living_data_002")
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 3)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutWithHeaders(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_with_headers_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages with and without headers", func() {
+			err := mq.PutWithHeaders([]byte("headers_data_000"), 0, map[string]string{
+				"trace-id": "abc123",
+			})
+			mq.Put([]byte("headers_data_001"), 0)
+
+			messages, _ := mq.GetConsumer().Get(2)
+
+			Convey("Then headers should be returned with the message", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+
+				v, ok := messages[0].Header("trace-id")
+				So(ok, ShouldBeTrue)
+				So(v, ShouldEqual, "abc123")
+				So(string(messages[0].GetBody()), ShouldEqual, "headers_data_000")
+
+				_, ok = messages[1].Header("trace-id")
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When putting headers reserved by the package", func() {
+			err := mq.PutWithHeaders([]byte("headers_data_002"), 1, map[string]string{
+				basePriorityHeader: "9",
+			})
+			mq.Put([]byte("headers_data_003"), 1)
+
+			messages, _ := mq.GetConsumer().Get(1)
+
+			Convey("Then they should be rejected and not returned", func() {
+				So(err, ShouldEqual, ErrReservedHeader)
+				So(len(messages), ShouldEqual, 1)
+
+				_, ok := messages[0].Header(basePriorityHeader)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutWithID(t *testing.T) {
+	Convey("Given created consumer", t, func() {
+		queueID := "test_put_with_id_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When putting messages with and without ID", func() {
+			err := mq.PutWithID("order-1", []byte("put_with_id_data_000"), 1)
+			mq.Put([]byte("put_with_id_data_001"), 0)
+
+			first, _ := c.Get(2)
+			c.ReQueue()
+			second, _ := c.Get(2)
+
+			Convey("Then IDs should be stable across requeue", func() {
+				So(err, ShouldBeNil)
+				So(len(first), ShouldEqual, 2)
+				So(len(second), ShouldEqual, 2)
+
+				So(first[0].ID(), ShouldEqual, "order-1")
+				So(second[0].ID(), ShouldEqual, "order-1")
+
+				So(first[1].ID(), ShouldNotBeEmpty)
+				So(second[1].ID(), ShouldEqual, first[1].ID())
+				So(second[1].member, ShouldNotEqual, first[1].member)
+			})
+		})
+
+		Convey("When putting a message with empty ID", func() {
+			err := mq.PutWithID("", []byte("put_with_id_data"), 0)
+
+			Convey("Then error should be occurred", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutUnique(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_unique_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting the same body repeatedly within window", func() {
+			first, err1 := mq.PutUnique([]byte("unique_data_000"), 1, 200*time.Millisecond)
+			second, err2 := mq.PutUnique([]byte("unique_data_000"), 1, 200*time.Millisecond)
+			other, err3 := mq.PutUnique([]byte("unique_data_001"), 1, 200*time.Millisecond)
+
+			Convey("Then only the first one should be put", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(err3, ShouldBeNil)
+				So(first, ShouldBeTrue)
+				So(second, ShouldBeFalse)
+				So(other, ShouldBeTrue)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 2)
+
+				// The body can be put again after window
+				time.Sleep(300 * time.Millisecond)
+
+				ok, err := mq.PutUnique([]byte("unique_data_000"), 1, 200*time.Millisecond)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+
+				l, _ = mq.Len()
+				So(l, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When putting with windows which are not positive", func() {
+			zero, err1 := mq.PutUnique([]byte("unique_data_002"), 1, 0)
+			negative, err2 := mq.PutUnique([]byte("unique_data_002"), 1, -time.Second)
+
+			Convey("Then they should be rejected without putting", func() {
+				So(err1, ShouldEqual, ErrInvalidWindow)
+				So(err2, ShouldEqual, ErrInvalidWindow)
+				So(zero, ShouldBeFalse)
+				So(negative, ShouldBeFalse)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutBatch(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_batch_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When putting messages in batch", func() {
+			var bodies [][]byte
+			var priorities []float64
+			for i := 0; i < 100; i++ {
+				num := fmt.Sprintf("%03d", i)
+				bodies = append(bodies, []byte("put_batch_data_"+num))
+				priorities = append(priorities, 0)
+			}
+			err := mq.PutBatch(bodies, priorities)
+
+			Convey("Then all data should be put in order", func() {
+				So(err, ShouldBeNil)
+
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				So(len(res.Val()), ShouldEqual, 100)
+				for i := range res.Val() {
+					num := fmt.Sprintf("%03d", i)
+					So(string(getBody(res.Val()[i])), ShouldEqual, "put_batch_data_"+num)
+				}
+			})
+		})
+
+		Convey("When putting messages with mismatched priorities", func() {
+			err := mq.PutBatch([][]byte{[]byte("a"), []byte("b")}, []float64{0})
+
+			Convey("Then error should be occurred and nothing should be put", func() {
+				So(err, ShouldNotBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_PutDelayed(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_put_delayed_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When putting a delayed message", func() {
+			body := "This is delayed data for tests"
+			err := mq.PutDelayed([]byte(body), 0, 300*time.Millisecond)
+
+			Convey("Then the message should not be delivered before delay elapses", func() {
+				So(err, ShouldBeNil)
+
+				messages, err := c.Get(10)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 0)
+
+				time.Sleep(400 * time.Millisecond)
+
+				messages, err = c.Get(10)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, body)
+				So(messages[0].GetPriority(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When putting delayed messages with priorities", func() {
+			mq.PutDelayed([]byte("low"), 1, 0)
+			mq.PutDelayed([]byte("high"), 2.5, 0)
+
+			Convey("Then ready messages should be delivered in priority order", func() {
+				messages, err := c.Get(10)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "high")
+				So(messages[0].GetPriority(), ShouldEqual, 2.5)
+				So(string(messages[1].GetBody()), ShouldEqual, "low")
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Len(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_len_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When getting length of missing queue", func() {
+			l, err := mq.Len()
+
+			Convey("Then zero should be returned", func() {
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 0)
+
+			})
+		})
+
+		Convey("When getting length after putting messages", func() {
+			for i := 0; i < 10; i++ {
+				num := fmt.Sprintf("%03d", i)
+				mq.Put([]byte("len_data_"+num), 0)
+			}
+			l, err := mq.Len()
+
+			Convey("Then the number of messages should be returned", func() {
+				So(err, ShouldBeNil)
+				So(l, ShouldEqual, 10)
+
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Purge(t *testing.T) {
+	Convey("Given config", t, func() {
+		queueID := "test_purge_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("purge_data_"+num), 0)
+		}
+
+		Convey("When purging the queue", func() {
+			err := mq.Purge()
+
+			Convey("Then all messages should be deleted", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+
+			})
+		})
+
+		Convey("When purging the queue with dead letters", func() {
+			mq.QuarantineAll()
+			err := mq.Purge()
+
+			Convey("Then dead letters should be deleted as well", func() {
+				So(err, ShouldBeNil)
+
+				dead, _ := mq.DeadLetters(10)
+				So(len(dead), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Remove(t *testing.T) {
+	Convey("Given created mq and saved data", t, func() {
+		queueID := "test_remove_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		m1, _ := mq.PutMessage([]byte("remove_data_000"), 0)
+		m2, _ := mq.PutMessage([]byte("remove_data_001"), 0)
+		mq.Put([]byte("remove_data_002"), 0)
+
+		Convey("When removing waiting and claimed messages", func() {
+			c := mq.GetConsumer()
+			c.Get(1)
+
+			claimed, err1 := mq.Remove(m1)
+			waiting, err2 := mq.Remove(m2)
+			again, err3 := mq.Remove(m2)
+
+			Convey("Then only the waiting message should be removed", func() {
+				So(err1, ShouldBeNil)
+				So(claimed, ShouldBeFalse)
+				So(err2, ShouldBeNil)
+				So(waiting, ShouldBeTrue)
+				So(err3, ShouldBeNil)
+				So(again, ShouldBeFalse)
+
+				messages, _ := mq.GetConsumer().Get(10)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, "remove_data_002")
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Recover(t *testing.T) {
+	Convey("Given created mq and data claimed by a dropped consumer", t, func() {
+		queueID := "test_recover_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		mq.Put([]byte("recover_data_000"), 2)
+		mq.Put([]byte("recover_data_001"), 1)
+		mq.Put([]byte("recover_data_002"), 0)
+
+		// The consumer is dropped without Ack like a crashed process
+		mq.GetConsumer().Get(2)
+
+		Convey("When recovering claims younger than the threshold", func() {
+			recovered, err := mq.Recover(time.Hour)
+
+			Convey("Then nothing should be recovered", func() {
+				So(err, ShouldBeNil)
+				So(recovered, ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When recovering stale claims", func() {
+			recovered, err := mq.Recover(0)
+
+			Convey("Then they should be delivered again with their priorities", func() {
+				So(err, ShouldBeNil)
+				So(recovered, ShouldEqual, 2)
+
+				messages, _ := mq.GetConsumer().Get(3)
+				So(len(messages), ShouldEqual, 3)
+				So(string(messages[0].GetBody()), ShouldEqual, "recover_data_000")
+				So(messages[0].GetPriority(), ShouldEqual, 2)
+				So(messages[0].DeliveryCount(), ShouldEqual, 2)
+				So(string(messages[2].GetBody()), ShouldEqual, "recover_data_002")
+				So(messages[2].DeliveryCount(), ShouldEqual, 1)
+
+				claimed, _ := mq.broker.redisClient.ZCard(queueID + processingSuffix).Result()
+				So(claimed, ShouldEqual, 3)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_AckByMember(t *testing.T) {
+	Convey("Given created mq and claimed data", t, func() {
+		queueID := "test_ack_by_member_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		mq.Put([]byte("ack_by_member_data_000"), 0)
+		mq.Put([]byte("ack_by_member_data_001"), 0)
+		messages, _ := mq.GetConsumer().Get(2)
+
+		Convey("When acking members from another mq", func() {
+			other, _ := NewPriorityMQ(cfg)
+			defer other.Close()
+
+			acked, err := other.AckByMember(messages[0].Member(), "unknown_member")
+			again, _ := other.AckByMember(messages[0].Member())
+
+			Convey("Then only claimed members should be reported", func() {
+				So(err, ShouldBeNil)
+				So(acked, ShouldResemble, []string{messages[0].Member()})
+				So(again, ShouldBeEmpty)
+
+				claimed, _ := mq.broker.redisClient.ZCard(queueID + processingSuffix).Result()
+				So(claimed, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_QuarantineAll(t *testing.T) {
+	Convey("Given created mq and saved data", t, func() {
+		queueID := "test_quarantine_all_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+		defer mq.broker.redisClient.Del(queueID + deadSuffix)
+
+		for i := 0; i < 5; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("quarantine_all_data_"+num), float64(i))
+		}
+		mq.PutDelayed([]byte("quarantine_all_delayed_data"), 10, time.Hour)
+		mq.GetConsumer().Get(1)
+
+		Convey("When quarantine all messages", func() {
+			n, err := mq.QuarantineAll()
+
+			Convey("Then waiting and delayed messages should be moved to the dead letter queue", func() {
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 5)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+
+				dead, _ := mq.DeadLetters(10)
+				So(len(dead), ShouldEqual, 5)
+				So(string(dead[0].GetBody()), ShouldEqual, "quarantine_all_delayed_data")
+				So(dead[0].GetPriority(), ShouldEqual, 10)
+				So(string(dead[1].GetBody()), ShouldEqual, "quarantine_all_data_003")
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_WaitAcked(t *testing.T) {
+	Convey("Given created mq and a message put", t, func() {
+		queueID := "test_wait_acked_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		m, _ := mq.PutMessage([]byte("wait_acked_data"), 0)
+		c := mq.GetConsumer()
+
+		Convey("When the message is acked while waiting", func() {
+			go func() {
+				c.Get(1)
+				time.Sleep(150 * time.Millisecond)
+				c.Ack()
+			}()
+
+			err := mq.WaitAcked(context.Background(), m)
+
+			Convey("Then it should return after ack", func() {
+				So(err, ShouldBeNil)
+				So(mq.WaitAcked(context.Background(), m), ShouldBeNil)
+			})
+		})
+
+		Convey("When ctx is done before ack", func() {
+			c.Get(1)
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+
+			err := mq.WaitAcked(ctx, m)
+
+			Convey("Then ctx error should be returned", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_DeadLetters(t *testing.T) {
+	Convey("Given config with max deliveries", t, func() {
+		queueID := "test_dead_letters_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:          queueID,
+			RedisAddr:     redisAddr,
+			RedisDB:       redisDB,
+			MaxDeliveries: 2,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+		defer mq.broker.redisClient.Del(queueID + deadSuffix)
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("dead_letters_data_"+num), 0)
+		}
+
+		Convey("When requeue messages less than max deliveries", func() {
+			c.Get(10)
+			err := c.ReQueue()
+
+			Convey("Then messages should be queued again", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+
+				messages, err := mq.DeadLetters(10)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When requeue messages reaching max deliveries", func() {
+			c.Get(10)
+			c.ReQueue()
+			c.Get(10)
+			err := c.ReQueue()
+
+			Convey("Then messages should be moved to dead letter queue", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+
+				messages, err := mq.DeadLetters(100)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "dead_letters_data_"+num)
+				}
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Info(t *testing.T) {
+	Convey("Given created mq and saved data", t, func() {
+		queueID := "test_info_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When getting info of an empty queue", func() {
+			info, err := mq.Info()
+
+			Convey("Then zero values should be returned", func() {
+				So(err, ShouldBeNil)
+				So(info.Len, ShouldEqual, 0)
+				So(info.Oldest.IsZero(), ShouldBeTrue)
+				So(info.Newest.IsZero(), ShouldBeTrue)
+			})
+		})
+
+		Convey("When getting info of a queue with data", func() {
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				num := fmt.Sprintf("%03d", i)
+				mq.Put([]byte("info_data_"+num), float64(i))
+			}
+			end := time.Now()
+
+			info, err := mq.Info()
+
+			Convey("Then the usage should be returned", func() {
+				So(err, ShouldBeNil)
+				So(info.Len, ShouldEqual, 10)
+				So(info.MemoryUsage, ShouldNotEqual, 0)
+				So(info.Oldest, ShouldHappenOnOrBetween, start.Truncate(time.Microsecond), end)
+				So(info.Newest, ShouldHappenOnOrBetween, info.Oldest, end)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Archive(t *testing.T) {
+	Convey("Given config archiving acked messages", t, func() {
+		queueID := "test_archive_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:         queueID,
+			RedisAddr:    redisAddr,
+			RedisDB:      redisDB,
+			ArchiveAcked: true,
+			ArchiveSize:  5,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("archive_data_"+num), 1)
+		}
+
+		Convey("When ack and requeue messages", func() {
+			c.Get(8)
+			c.Ack()
+			c.Get(2)
+			c.ReQueue()
+
+			messages, err := mq.Archive(10)
+
+			Convey("Then only the last acked messages should be archived", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 5)
+				So(string(messages[0].GetBody()), ShouldEqual, "archive_data_007")
+				So(string(messages[4].GetBody()), ShouldEqual, "archive_data_003")
+				So(messages[0].GetPriority(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Stats(t *testing.T) {
+	Convey("Given MessageQueue instance", t, func() {
+		queueID := "test_stats_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When putting, getting, acking and requeueing messages", func() {
+			for i := 0; i < 10; i++ {
+				num := fmt.Sprintf("%03d", i)
+				mq.Put([]byte("stats_data_"+num), 0)
+			}
+			c.Get(3)
+			c.Ack()
+			c.Get(2)
+			c.ReQueue()
+
+			Convey("Then counters should be reported", func() {
+				stats := mq.Stats()
+				So(stats.Put, ShouldEqual, 10)
+				So(stats.Gotten, ShouldEqual, 5)
+				So(stats.Acked, ShouldEqual, 3)
+				So(stats.ReQueued, ShouldEqual, 2)
+				So(stats.Len, ShouldEqual, 7)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Ping(t *testing.T) {
+	Convey("Given created mq", t, func() {
+		queueID := "test_ping_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+
+		Convey("When pinging", func() {
+			err := mq.Ping()
+			mq.Close()
+
+			Convey("Then redis should respond until mq is closed", func() {
+				So(err, ShouldBeNil)
+				So(mq.Ping(), ShouldEqual, ErrClosed)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_RedisClient(t *testing.T) {
+	Convey("Given created mq", t, func() {
+		queueID := "test_redis_client_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When getting redis client", func() {
+			rc := mq.RedisClient()
+
+			Convey("Then it should share the connection of mq", func() {
+				So(rc, ShouldEqual, mq.broker.redisClient)
+
+				mq.Put([]byte("redis_client_data"), 0)
+				n, err := rc.ZCard(queueID).Result()
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Close(t *testing.T) {
+	Convey("Given MessageQueue instance and claimed data", t, func() {
+		queueID := "test_close_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		mq.Put([]byte("close_data"), 0)
+
+		c := mq.GetConsumer()
+		c.Get(1)
+
+		Convey("When closing twice", func() {
+			mq.Close()
+
+			Convey("Then it should not panic", func() {
+				So(mq.Close, ShouldNotPanic)
+			})
+		})
+
+		Convey("When operating after close", func() {
+			mq.Close()
+			putErr := mq.Put([]byte("close_data"), 0)
+			ackErr := c.Ack()
+			_, getErr := mq.GetConsumer().Get(1)
+
+			Convey("Then ErrClosed should be returned", func() {
+				So(putErr, ShouldEqual, ErrClosed)
+				So(ackErr, ShouldEqual, ErrClosed)
+				So(getErr, ShouldEqual, ErrClosed)
+			})
+		})
+
+		Reset(func() {
+			rc := redis.NewClient(&redis.Options{Addr: redisAddr, DB: redisDB})
+			defer rc.Close()
+			rc.Del(queueID, queueID+processingSuffix, queueID+claimsSuffix)
+		})
+	})
+}
+
+func TestMessageQueue_CloseGraceful(t *testing.T) {
+	Convey("Given MessageQueue instance and claimed data", t, func() {
+		queueID := "test_close_graceful_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("close_graceful_data_"+num), 0)
+		}
+
+		c := mq.GetConsumer()
+		c.Get(3)
+
+		Convey("When closing with messages still in flight", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			mq.Purge()
+			err := mq.CloseGraceful(ctx)
+
+			Convey("Then error should be returned", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "3 messages are still in flight")
+			})
+		})
+
+		Convey("When closing after the messages are acked", func() {
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				c.Ack()
+			}()
+			mq.Purge()
+			err := mq.CloseGraceful(context.Background())
+
+			Convey("Then it should be closed without error", func() {
+				So(err, ShouldBeNil)
+				So(mq.Put([]byte("close_graceful_data"), 0), ShouldEqual, ErrClosed)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_Queue(t *testing.T) {
+	Convey("Given created mq", t, func() {
+		queueID := "test_queue_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When using another queue sharing the connection", func() {
+			other := mq.Queue(queueID + "_other")
+			defer other.Purge()
+
+			mq.Put([]byte("queue_data_000"), 0)
+			other.Put([]byte("queue_other_data_000"), 0)
+			other.Put([]byte("queue_other_data_001"), 0)
+
+			c := other.GetConsumer()
+			messages, err := c.Get(10)
+			ackErr := c.Ack()
+
+			Convey("Then messages should be put, gotten and acked on its own key", func() {
+				So(other.broker.redisClient, ShouldEqual, mq.broker.redisClient)
+
+				So(err, ShouldBeNil)
+				So(ackErr, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "queue_other_data_000")
+
+				res := mq.broker.redisClient.ZRange(queueID+"_other"+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+				So(other.Stats().Acked, ShouldEqual, 2)
+				So(mq.Stats().Acked, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_GetReader(t *testing.T) {
+	Convey("Given created mq and saved data", t, func() {
+		queueID := "test_get_reader_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("get_reader_data_"+num), 0)
+		}
+
+		Convey("When reading data with a reader", func() {
+			r := mq.GetReader()
+			head, err1 := r.Peek(3)
+			middle, err2 := r.PeekRange(5, 2)
+			found, err3 := r.Find(context.Background(), func(body []byte) bool {
+				return string(body) == "get_reader_data_007"
+			}, 0)
+			l, err4 := r.Len()
+
+			Convey("Then data should be read without claiming", func() {
+				So(err1, ShouldBeNil)
+				So(len(head), ShouldEqual, 3)
+				So(string(head[0].GetBody()), ShouldEqual, "get_reader_data_000")
+				So(err2, ShouldBeNil)
+				So(len(middle), ShouldEqual, 2)
+				So(string(middle[0].GetBody()), ShouldEqual, "get_reader_data_005")
+				So(err3, ShouldBeNil)
+				So(len(found), ShouldEqual, 1)
+				So(err4, ShouldBeNil)
+				So(l, ShouldEqual, 10)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestMessageQueue_GetConsumer(t *testing.T) {
+	Convey("Given MessageQueue instance", t, func() {
+		queueID := "test_get_consumer_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		Convey("When get a new consumer", func() {
+			c := mq.GetConsumer()
+
+			Convey("Then valid consumer should be created", func() {
+				So(c, ShouldNotBeNil)
+				So(c.broker, ShouldNotBeNil)
+
+			})
+		})
+	})
+}
+
+func TestConsumer_Get(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_get_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_data_"+num), 0)
+		}
+
+		Convey("When get data with consumer", func() {
+			messages, err := c.Get(10)
+
+			Convey("Then expectd data should be returnedj", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_data_"+num)
+					So(messages[i].GetPriority(), ShouldEqual, 0)
+				}
+			})
+		})
+
+		Convey("When duplicate get data with consumer", func() {
+			messages, err := c.Get(10)
+
+			Convey("Then expectd data should be returnedj", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_data_"+num)
+					So(messages[i].GetPriority(), ShouldEqual, 0)
+				}
+			})
+		})
+
+		Convey("When get data after a part of the batch is acked", func() {
+			batch, _ := c.Get(10)
+			c.AckMessages(batch[:4])
+			messages, err := c.Get(10)
+
+			Convey("Then new data should be returned and the rest of the batch should stay claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i+10)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_data_"+num)
+				}
+
+				So(len(c.notAckedMessages), ShouldEqual, 16)
+				So(c.notAckedMessages.contains(batch[4].member), ShouldBeTrue)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 16)
+			})
+		})
+
+		Convey("When get data after the batch is acked", func() {
+			c.Get(10)
+			c.Ack()
+			messages, err := c.Get(10)
+
+			Convey("Then new data should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_get_data_010")
+				So(len(c.notAckedMessages), ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestConsumer_Get_Order(t *testing.T) {
+	Convey("Given created consumer and data with mixed priorities", t, func() {
+		queueID := "test_consumer_get_order_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		// Bodies sort against the put order to make sure they don't break ties
+		puts := []struct {
+			body     string
+			priority float64
+		}{
+			{"z_low", 1},
+			{"y_high", 3},
+			{"x_low", 1},
+			{"w_middle", 2.5},
+			{"v_high", 3},
+			{"u_negative", -1},
+			{"t_middle", 2.5},
+			{"s_low", 1},
+		}
+		for _, p := range puts {
+			mq.Put([]byte(p.body), p.priority)
+		}
+
+		Convey("When get all data", func() {
+			messages, err := c.Get(0)
+
+			Convey("Then data should be ordered by priority and then by put order", func() {
+				So(err, ShouldBeNil)
+
+				var bodies []string
+				for i := range messages {
+					bodies = append(bodies, string(messages[i].GetBody()))
+				}
+				So(bodies, ShouldResemble, []string{
+					"y_high", "v_high",
+					"w_middle", "t_middle",
+					"z_low", "x_low", "s_low",
+					"u_negative",
+				})
+			})
+		})
+	})
+}
+
+func TestConsumer_GetNewest(t *testing.T) {
+	Convey("Given created consumer and data with mixed priorities", t, func() {
+		queueID := "test_consumer_get_newest_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		mq.Put([]byte("a_low"), 1)
+		mq.Put([]byte("b_high"), 3)
+		mq.Put([]byte("c_low"), 1)
+		mq.Put([]byte("d_high"), 3)
+
+		Convey("When get newest data", func() {
+			messages, err := c.GetNewest(3)
+
+			Convey("Then data should be ordered by priority and then newest first", func() {
+				So(err, ShouldBeNil)
+
+				var bodies []string
+				for i := range messages {
+					bodies = append(bodies, string(messages[i].GetBody()))
+				}
+				So(bodies, ShouldResemble, []string{"d_high", "b_high", "c_low"})
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestConsumer_Get_Concurrent(t *testing.T) {
+	Convey("Given two consumers on the same queue and saved data", t, func() {
+		queueID := "test_consumer_get_concurrent_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c1 := mq.GetConsumer()
+		c2 := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_concurrent_data_"+num), 0)
+		}
+
+		Convey("When both consumers get data concurrently", func() {
+			type result struct {
+				messages PrioritizedMessages
+				err      error
+			}
+			resC := make(chan result, 2)
+			for _, c := range []*Consumer{c1, c2} {
+				go func(c *Consumer) {
+					messages, err := c.Get(30)
+					resC <- result{messages: messages, err: err}
+				}(c)
+			}
+			r1, r2 := <-resC, <-resC
+
+			Convey("Then result sets should be disjoint", func() {
+				So(r1.err, ShouldBeNil)
+				So(r2.err, ShouldBeNil)
+				So(len(r1.messages), ShouldEqual, 30)
+				So(len(r2.messages), ShouldEqual, 30)
+
+				seen := make(map[string]bool)
+				for _, m := range append(r1.messages, r2.messages...) {
+					So(seen[m.member], ShouldBeFalse)
+					seen[m.member] = true
+				}
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 40)
+			})
+		})
+	})
+}
+
+func TestConsumer_Get_Malformed(t *testing.T) {
+	Convey("Given created consumer and saved data with malformed members", t, func() {
+		queueID := "test_consumer_get_malformed_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		logger := &testLogger{}
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+			Logger:    logger,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+		defer mq.broker.redisClient.Del(queueID + deadSuffix)
+
+		c := mq.GetConsumer()
+
+		mq.Put([]byte("consumer_get_malformed_data_000"), 0)
+		mq.broker.redisClient.ZAdd(queueID, redis.Z{Member: "short", Score: 0}, redis.Z{Member: "", Score: 0})
+		mq.Put([]byte("consumer_get_malformed_data_001"), 0)
+		mq.Put([]byte("consumer_get_malformed_data_002"), 0)
+
+		Convey("When get data", func() {
+			messages, err := c.Get(2)
+
+			Convey("Then malformed members should be skipped and moved to the dead letter queue", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_get_malformed_data_000")
+				So(string(messages[1].GetBody()), ShouldEqual, "consumer_get_malformed_data_001")
+				So(len(logger.logs), ShouldBeGreaterThan, 0)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 2)
+
+				dead := mq.broker.redisClient.ZRange(queueID+deadSuffix, 0, -1)
+				So(dead.Val(), ShouldResemble, []string{""})
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetFair(t *testing.T) {
+	Convey("Given created consumer and data from producers", t, func() {
+		queueID := "test_consumer_get_fair_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 6; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.PutFrom("bursty", []byte("get_fair_bursty_data_"+num), 0)
+		}
+		mq.PutFrom("quiet", []byte("get_fair_quiet_data_000"), 0)
+		mq.PutFrom("quiet", []byte("get_fair_quiet_data_001"), 0)
+
+		Convey("When get fair", func() {
+			messages, err := c.GetFair(5)
+
+			Convey("Then producers should take turns", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 5)
+				So(string(messages[0].GetBody()), ShouldEqual, "get_fair_bursty_data_000")
+				So(string(messages[1].GetBody()), ShouldEqual, "get_fair_quiet_data_000")
+				So(string(messages[2].GetBody()), ShouldEqual, "get_fair_bursty_data_001")
+				So(string(messages[3].GetBody()), ShouldEqual, "get_fair_quiet_data_001")
+				So(string(messages[4].GetBody()), ShouldEqual, "get_fair_bursty_data_002")
+				So(messages[1].Producer(), ShouldEqual, "quiet")
+
+				So(len(c.notAckedMessages), ShouldEqual, 5)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When get fair with a delayed message which is ready", func() {
+			mq.Purge()
+			mq.PutDelayed([]byte("get_fair_delayed_data"), 0, 10*time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+
+			messages, err := c.GetFair(1)
+
+			Convey("Then it should be delivered", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, "get_fair_delayed_data")
+			})
+		})
+
+		Convey("When get fair with expired messages filling the head", func() {
+			mq.Purge()
+			for i := 0; i < fairWindow; i++ {
+				num := fmt.Sprintf("%03d", i)
+				mq.PutWithTTL([]byte("get_fair_expired_data_"+num), 1, 10*time.Millisecond)
+			}
+			mq.PutFrom("quiet", []byte("get_fair_live_data"), 0)
+			time.Sleep(50 * time.Millisecond)
+
+			messages, err := c.GetFair(1)
+
+			Convey("Then expired messages should be removed and a live one should be delivered", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, "get_fair_live_data")
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetBatch(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_get_batch_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_batch_data_"+num), 0)
+		}
+
+		Convey("When getting batches and settling them separately", func() {
+			id1, messages1, err1 := c.GetBatch(3)
+			id2, messages2, err2 := c.GetBatch(3)
+
+			So(err1, ShouldBeNil)
+			So(err2, ShouldBeNil)
+			So(id1, ShouldNotEqual, id2)
+			So(len(messages1), ShouldEqual, 3)
+			So(len(messages2), ShouldEqual, 3)
+			So(string(messages1[0].GetBody()), ShouldEqual, "consumer_get_batch_data_000")
+			So(string(messages2[0].GetBody()), ShouldEqual, "consumer_get_batch_data_003")
+			So(len(c.notAckedMessages), ShouldEqual, 6)
+
+			ackErr := c.AckBatch(id1)
+			requeueErr := c.ReQueueBatch(id2)
+
+			Convey("Then each batch should be settled by its ID", func() {
+				So(ackErr, ShouldBeNil)
+				So(requeueErr, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+				So(len(c.batches), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 7)
+				So(c.AckBatch(id1), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetIterator(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_get_iterator_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_iterator_data_"+num), 0)
+		}
+
+		Convey("When iterating a part of messages and closing", func() {
+			it, err := c.GetIterator(5)
+			So(err, ShouldBeNil)
+
+			var bodies []string
+			for i := 0; i < 3 && it.Next(); i++ {
+				m := it.Message()
+				bodies = append(bodies, string(m.GetBody()))
+			}
+			closeErr := it.Close()
+
+			Convey("Then only consumed messages should be acked", func() {
+				So(it.Err(), ShouldBeNil)
+				So(closeErr, ShouldBeNil)
+				So(bodies, ShouldResemble, []string{
+					"consumer_get_iterator_data_000",
+					"consumer_get_iterator_data_001",
+					"consumer_get_iterator_data_002",
+				})
+				So(len(c.notAckedMessages), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When iterating all messages with AckConsumed", func() {
+			it, _ := c.GetIterator(5)
+			it.AckConsumed = true
+
+			var n int
+			for it.Next() {
+				n++
+				So(len(c.notAckedMessages), ShouldEqual, 6-n)
+			}
+
+			Convey("Then each message should be acked as the iterator moves past it", func() {
+				So(it.Err(), ShouldBeNil)
+				So(n, ShouldEqual, 5)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+				So(it.Close(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetContext(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_get_context_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_context_data_"+num), 0)
+		}
+
+		Convey("When get data with context", func() {
+			messages, err := c.GetContext(context.Background(), 10)
+
+			Convey("Then expectd data should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_context_data_"+num)
+				}
+			})
+		})
+
+		Convey("When get data with cancelled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			messages, err := c.GetContext(ctx, 10)
+
+			Convey("Then context error should be returned and nothing should be claimed", func() {
+				So(err, ShouldEqual, context.Canceled)
+				So(len(messages), ShouldEqual, 0)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When context is cancelled while redis claims data", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			rc := mq.broker.redisClient
+			mq.broker.redisClient = &cancelingClient{redisCmdable: rc, cancel: cancel}
+			messages, err := c.GetContext(ctx, 10)
+			mq.broker.redisClient = rc
+
+			Convey("Then claimed data should be put back where it was", func() {
+				So(err, ShouldEqual, context.Canceled)
+				So(len(messages), ShouldEqual, 0)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 100)
+				claimed, _ := rc.ZCard(queueID + processingSuffix).Result()
+				So(claimed, ShouldEqual, 0)
+
+				messages, _ = c.Get(1)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_get_context_data_000")
+				So(messages[0].DeliveryCount(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+// cancelingClient cancels a context when a script is sent like a caller giving up while redis runs it
+type cancelingClient struct {
+	redisCmdable
+	cancel context.CancelFunc
+}
+
+func (c *cancelingClient) EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd {
+	c.cancel()
+	return c.redisCmdable.EvalSha(sha1, keys, args...)
+}
+
+func (c *cancelingClient) Eval(script string, keys []string, args ...interface{}) *redis.Cmd {
+	c.cancel()
+	return c.redisCmdable.Eval(script, keys, args...)
+}
+
+func TestConsumer_GetAbovePriority(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_get_above_priority_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_get_above_priority_data_"+num), float64(i))
+		}
+
+		Convey("When get data above priority", func() {
+			messages, err := c.GetAbovePriority(10, 7)
+
+			Convey("Then only messages at or above the priority should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+				So(messages[0].GetPriority(), ShouldEqual, 9)
+				So(messages[1].GetPriority(), ShouldEqual, 8)
+				So(messages[2].GetPriority(), ShouldEqual, 7)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 7)
+			})
+		})
+
+		Convey("When get data above priority with negative priority", func() {
+			messages, err := c.GetAbovePriority(2, -1)
+
+			Convey("Then the highest messages should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(messages[0].GetPriority(), ShouldEqual, 9)
+			})
+		})
+	})
+}
+
+func TestConsumer_Close(t *testing.T) {
+	Convey("Given created consumers and claimed data", t, func() {
+		queueID := "test_consumer_close_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c1 := mq.GetConsumer()
+		c2 := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_close_data_"+num), 0)
+		}
+		c1.Get(3)
+
+		Convey("When closing a consumer", func() {
+			err := c1.Close()
+
+			Convey("Then its messages should be queued again and others should keep working", func() {
+				So(err, ShouldBeNil)
+				So(len(c1.notAckedMessages), ShouldEqual, 0)
+
+				_, err = c1.Get(1)
+				So(err, ShouldEqual, ErrClosed)
+
+				messages, err := c2.Get(10)
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestConsumer_Pop(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_pop_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		mq.Put([]byte("consumer_pop_data_000"), 1)
+		mq.Put([]byte("consumer_pop_data_001"), 2)
+		mq.Put([]byte("consumer_pop_data_002"), 0)
+
+		c := mq.GetConsumer()
+
+		Convey("When popping data", func() {
+			messages, err := c.Pop(2)
+
+			Convey("Then messages should be removed without being claimed", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_pop_data_001")
+				So(string(messages[1].GetBody()), ShouldEqual, "consumer_pop_data_000")
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 1)
+				claimed, _ := mq.broker.redisClient.ZCard(queueID + processingSuffix).Result()
+				So(claimed, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConsumer_HandleSignals(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_handle_signals_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		for i := 0; i < 3; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_handle_signals_data_"+num), 0)
+		}
+
+		c := mq.GetConsumer()
+		ctx, stop := c.HandleSignals(context.Background())
+		c.Get(2)
+
+		Convey("When the process receives SIGTERM and the loop exits", func() {
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+			<-ctx.Done()
+			err := stop()
+
+			Convey("Then claimed messages should be queued again", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 3)
+
+				_, err := c.Get(1)
+				So(err, ShouldEqual, ErrClosed)
+			})
+		})
+	})
+}
+
+func TestConsumer_Peek(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_peek_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_peek_data_"+num), 0)
+		}
+
+		Convey("When peek data twice", func() {
+			c.Peek(10)
+			messages, err := c.Peek(10)
+
+			Convey("Then head data should be returned without claiming", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 10)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_peek_data_"+num)
+				}
+
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 100)
+			})
+		})
+	})
+}
+
+func TestConsumer_Find(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_find_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 300; i++ {
+			mq.Put([]byte(fmt.Sprintf("consumer_find_data_user_%d", i%3)), float64(i))
+		}
+		match := func(body []byte) bool {
+			return strings.HasSuffix(string(body), "_user_1")
+		}
+
+		Convey("When finding data", func() {
+			messages, err := c.Find(context.Background(), match, 0)
+			limited, limitedErr := c.Find(context.Background(), match, 10)
+
+			Convey("Then matching data should be returned without claiming", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 100)
+				for i := range messages {
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_find_data_user_1")
+				}
+
+				So(limitedErr, ShouldBeNil)
+				So(len(limited), ShouldEqual, 10)
+
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 300)
+			})
+		})
+
+		Convey("When finding data with cancelled context", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.Find(ctx, match, 0)
+
+			Convey("Then context error should be returned", func() {
+				So(err, ShouldEqual, context.Canceled)
+			})
+		})
+	})
+}
+
+func TestConsumer_PeekTail(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_peek_tail_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_peek_tail_data_"+num), float64(i))
+		}
+
+		Convey("When peek tail data", func() {
+			messages, err := c.PeekTail(3)
+
+			Convey("Then lowest priority data should be returned without claiming", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 3)
+
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_peek_tail_data_"+num)
+					So(messages[i].GetPriority(), ShouldEqual, float64(i))
+				}
+
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestConsumer_PeekRange(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_peek_range_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 20; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_peek_range_data_"+num), 0)
+		}
+
+		Convey("When peek a page", func() {
+			messages, err := c.PeekRange(10, 5)
+
+			Convey("Then the page should be returned without claiming", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 5)
+				for i := range messages {
+					num := fmt.Sprintf("%03d", i+10)
+					So(string(messages[i].GetBody()), ShouldEqual, "consumer_peek_range_data_"+num)
+				}
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 20)
+			})
+		})
+
+		Convey("When peek a page over the tail", func() {
+			messages, err := c.PeekRange(18, 5)
+
+			Convey("Then the rest should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When peek out of range", func() {
+			messages1, err1 := c.PeekRange(100, 5)
+			messages2, err2 := c.PeekRange(-1, 5)
+
+			Convey("Then empty slice should be returned", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(len(messages1), ShouldEqual, 0)
+				So(len(messages2), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConsumer_UpdatePriority(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_update_priority_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_update_priority_data_"+num), 0)
+		}
+
+		Convey("When updating priority of a queued message", func() {
+			messages, _ := c.Peek(10)
+			err := c.UpdatePriority(messages[9], 10)
+
+			Convey("Then the message should be moved to the head", func() {
+				So(err, ShouldBeNil)
+
+				messages, _ := c.Get(1)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_update_priority_data_009")
+				So(messages[0].GetPriority(), ShouldEqual, 10)
+			})
+		})
+
+		Convey("When updating priority of a message which is not queued", func() {
+			m, _ := mq.broker.newMessage([]byte("not_queued"), 0, 0)
+			err := c.UpdatePriority(m, 10)
+
+			Convey("Then the message should not be added", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetBlocking(t *testing.T) {
+	Convey("Given created consumer", t, func() {
+		queueID := "test_consumer_get_blocking_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When get data from empty queue", func() {
+			messages, err := c.GetBlocking(10, 200*time.Millisecond)
+
+			Convey("Then timeout error should be returned", func() {
+				So(err, ShouldEqual, ErrTimeout)
+				So(len(messages), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When data is put while waiting", func() {
+			go func() {
+				time.Sleep(200 * time.Millisecond)
+				mq.Put([]byte("consumer_get_blocking_data"), 0)
+			}()
+			messages, err := c.GetBlocking(10, 2*time.Second)
+
+			Convey("Then put data should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_get_blocking_data")
+			})
+		})
+	})
+}
+
+func TestConsumer_GetBlockingContext(t *testing.T) {
+	Convey("Given created consumer and empty queue", t, func() {
+		queueID := "test_consumer_get_blocking_context_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When ctx is cancelled while waiting", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			messages, err := c.GetBlockingContext(ctx, 10, time.Minute)
+			elapsed := time.Since(start)
+
+			Convey("Then it should return promptly with ctx error", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+				So(len(messages), ShouldEqual, 0)
+				So(elapsed, ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Convey("When a message is put while waiting", func() {
+			go func() {
+				time.Sleep(150 * time.Millisecond)
+				mq.Put([]byte("get_blocking_context_data"), 0)
+			}()
+
+			messages, err := c.GetBlockingContext(context.Background(), 10, time.Second)
+
+			Convey("Then it should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestConsumer_GetWithBackoff(t *testing.T) {
+	Convey("Given created consumer and empty queue", t, func() {
+		queueID := "test_consumer_get_with_backoff_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When a message is put while backing off", func() {
+			go func() {
+				time.Sleep(150 * time.Millisecond)
+				mq.Put([]byte("get_with_backoff_data"), 0)
+			}()
+
+			messages, err := c.GetWithBackoff(context.Background(), 10, 10*time.Millisecond, 100*time.Millisecond)
+
+			Convey("Then it should be returned", func() {
+				So(err, ShouldBeNil)
+				So(len(messages), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When ctx is cancelled while backing off", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			messages, err := c.GetWithBackoff(ctx, 10, time.Second, time.Minute)
+			elapsed := time.Since(start)
+
+			Convey("Then it should return promptly with ctx error", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+				So(len(messages), ShouldEqual, 0)
+				So(elapsed, ShouldBeLessThan, time.Second)
+			})
+		})
+	})
+}
+
+func TestConsumer_Notifications(t *testing.T) {
+	Convey("Given config publishing events", t, func() {
+		queueID := "test_consumer_notifications_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:          queueID,
+			RedisAddr:     redisAddr,
+			RedisDB:       redisDB,
+			PublishEvents: true,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		Convey("When a message is put while waiting for notifications", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			notifyC, err := c.Notifications(ctx)
+			So(err, ShouldBeNil)
+
+			mq.Put([]byte("notifications_data"), 0)
+
+			var notified bool
+			select {
+			case <-notifyC:
+				notified = true
+			case <-time.After(time.Second):
+			}
+			cancel()
+
+			Convey("Then it should be notified and the channel should be closed after cancel", func() {
+				So(notified, ShouldBeTrue)
+
+				messages, _ := c.Get(10)
+				So(len(messages), ShouldEqual, 1)
+
+				_, ok := <-notifyC
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
+func TestConsumer_Consume(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_consume_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_consume_data_"+num), 0)
+		}
+
+		Convey("When consuming until cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			var bodies []string
+			failed := false
+			err := c.Consume(ctx, 10, func(messages PrioritizedMessages) error {
+				if !failed {
+					failed = true
+					return fmt.Errorf("failed")
+				}
+				for i := range messages {
+					bodies = append(bodies, string(messages[i].GetBody()))
+				}
+				return nil
+			})
+
+			Convey("Then all messages should be handled and acked", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+				So(len(bodies), ShouldEqual, 100)
+				So(bodies[0], ShouldEqual, "consumer_consume_data_010")
+				So(bodies[90], ShouldEqual, "consumer_consume_data_000")
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConsumer_Drain(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_drain_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_drain_data_"+num), 0)
+		}
+
+		Convey("When draining the queue", func() {
+			messageC, errC := c.Drain(context.Background(), 30)
+
+			var bodies []string
+			for m := range messageC {
+				bodies = append(bodies, string(m.GetBody()))
+			}
+			err := <-errC
+
+			Convey("Then all messages should be emitted in order and acked", func() {
+				So(err, ShouldBeNil)
+				So(len(bodies), ShouldEqual, 100)
+				for i := range bodies {
+					num := fmt.Sprintf("%03d", i)
+					So(bodies[i], ShouldEqual, "consumer_drain_data_"+num)
+				}
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 0)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When draining is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			messageC, errC := c.Drain(ctx, 30)
+
+			<-messageC
+			cancel()
+			for range messageC {
+			}
+			err := <-errC
+
+			Convey("Then the interrupted batch should be queued again", func() {
+				So(err, ShouldEqual, context.Canceled)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 100)
+			})
+		})
+	})
+}
+
+func TestConsumer_Pending(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_pending_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_pending_data_"+num), 0)
+		}
+
+		messages, _ := c.Get(5)
+		c.AckMessage(messages[0])
+
+		Convey("When getting pending messages", func() {
+			pending := c.Pending()
+
+			Convey("Then a copy of claimed messages should be returned", func() {
+				So(len(pending), ShouldEqual, 4)
+				for i := range pending {
+					So(pending[i].member, ShouldEqual, messages[i+1].member)
+				}
+
+				pending[0].AddPriority(10)
+				So(c.notAckedMessages[0].GetPriority(), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestConsumer_Reset(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_reset_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_reset_data_"+num), 0)
+		}
+		c.Get(5)
+
+		Convey("When reset", func() {
+			c.Reset()
+
+			Convey("Then claimed messages should be forgotten only in memory", func() {
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+				So(atomic.LoadInt64(&mq.broker.inFlight), ShouldEqual, 0)
+
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 5)
+
+				messages, _ := c.Get(10)
+				So(len(messages), ShouldEqual, 5)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_reset_data_005")
+			})
+		})
+	})
+}
+
+func TestConsumer_Ack(t *testing.T) {
+	Convey("Given created consumer and saved data", t, func() {
+		queueID := "test_consumer_ack_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 100; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_ack_data_"+num), 0)
+		}
+
+		Convey("When get and ack", func() {
+			c.Get(10)
+			err := c.Ack()
+
+			Convey("Then acked members should be deleted", func() {
+				So(err, ShouldBeNil)
+				res := mq.broker.redisClient.ZRange(queueID, 0, 99)
+				So(len(res.Val()), ShouldEqual, 90)
+				for i := 0; i < 90; i++ {
+					num := fmt.Sprintf("%03d", i+10)
+					So(string(getBody(res.Val()[i])), ShouldEqual, "consumer_ack_data_"+num)
+				}
+
+				So(len(c.notAckedMessages), ShouldEqual, 0)
 
 			})
 		})
 
-		Convey("When creating new mq", func() {
-			mq, err := NewPriorityMQ(cfg)
-			defer mq.Close()
+		Convey("When ack twice and ack messages removed by others", func() {
+			messages, _ := c.Get(10)
+			err1 := c.AckMessage(messages[0])
+			err2 := c.AckMessage(messages[0])
+			mq.broker.redisClient.Del(queueID + processingSuffix)
+			err3 := c.Ack()
+			err4 := c.Ack()
 
-			Convey("Then a new one should be created", func() {
-				So(err, ShouldBeNil)
-				So(mq, ShouldNotBeNil)
+			Convey("Then all of them should succeed", func() {
+				So(err1, ShouldBeNil)
+				So(err2, ShouldBeNil)
+				So(err3, ShouldBeNil)
+				So(err4, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+				So(mq.Stats().Acked, ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func TestConsumer_Ack_PartialFailure(t *testing.T) {
+	Convey("Given consumer whose ack partially fails", t, func() {
+		b := &broker{
+			codec:        PrefixCodec{},
+			consumerAckC: make(chan *consumerAck),
+			quit:         make(chan struct{}),
+			now:          time.Now,
+		}
+		defer close(b.quit)
+
+		// Fail to remove the first member of each ack
+		go func() {
+			for {
+				select {
+				case ca := <-b.consumerAckC:
+					ca.failed = ca.members[:1]
+					ca.errC <- io.EOF
+					close(ca.errC)
+				case <-b.quit:
+					return
+				}
+			}
+		}()
+
+		c := &Consumer{
+			broker: b,
+		}
+		for i := 0; i < 3; i++ {
+			m, _ := b.newMessage([]byte(fmt.Sprintf("partial_data_%03d", i)), 0, 0)
+			c.notAckedMessages = append(c.notAckedMessages, m)
+		}
+		messages := c.notAckedMessages
+
+		Convey("When ack", func() {
+			err := c.Ack()
+
+			Convey("Then only failed messages should stay claimed", func() {
+				ackErr, ok := err.(*AckError)
+				So(ok, ShouldBeTrue)
+				So(ackErr.Err, ShouldEqual, io.EOF)
+				So(len(ackErr.Failed), ShouldEqual, 1)
+				So(ackErr.Failed[0].member, ShouldEqual, messages[0].member)
 
+				So(len(c.notAckedMessages), ShouldEqual, 1)
+				So(c.notAckedMessages[0].member, ShouldEqual, messages[0].member)
+				So(b.stats.Acked, ShouldEqual, 2)
 			})
 		})
 	})
 }
 
-func TestMessageQueue_Put(t *testing.T) {
-	Convey("Given config", t, func() {
-		queueID := "test_put_mq"
+func TestConsumer_AckMessage(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_ack_message_mq"
 		redisAddr := "localhost:6379"
 		redisDB := 1
 		cfg := Config{
@@ -57,28 +4240,45 @@ func TestMessageQueue_Put(t *testing.T) {
 
 		mq, _ := NewPriorityMQ(cfg)
 		defer mq.Close()
-		defer mq.broker.redisClient.Del(queueID)
+		defer mq.Purge()
 
-		Convey("When putting a new message", func() {
-			body := "This is put data for tests"
-			err := mq.Put([]byte(body), 0)
+		c := mq.GetConsumer()
 
-			Convey("Then the data should be put into target db", func() {
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_ack_message_data_"+num), 0)
+		}
+
+		messages, _ := c.Get(10)
+
+		Convey("When ack a single message", func() {
+			err := c.AckMessage(messages[3])
+
+			Convey("Then only the message should be acked", func() {
 				So(err, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 9)
+				So(c.notAckedMessages.contains(messages[3].member), ShouldBeFalse)
 
-				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
-				vals := res.Val()
-				So(len(vals), ShouldEqual, 1)
-				So(string(getBody(vals[0])), ShouldEqual, body)
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 9)
+			})
+		})
+
+		Convey("When ack a message which is not claimed", func() {
+			m, _ := mq.broker.newMessage([]byte("not_claimed"), 0, 0)
+			err := c.AckMessage(m)
 
+			Convey("Then nothing should be changed", func() {
+				So(err, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 10)
 			})
 		})
 	})
 }
 
-func TestMessageQueue_GetConsumer(t *testing.T) {
-	Convey("Given MessageQueue instance", t, func() {
-		queueID := "test_get_consumer_mq"
+func TestConsumer_AckMessages(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_ack_messages_mq"
 		redisAddr := "localhost:6379"
 		redisDB := 1
 		cfg := Config{
@@ -89,23 +4289,38 @@ func TestMessageQueue_GetConsumer(t *testing.T) {
 
 		mq, _ := NewPriorityMQ(cfg)
 		defer mq.Close()
-		defer mq.broker.redisClient.Del(queueID)
+		defer mq.Purge()
 
-		Convey("When get a new consumer", func() {
-			c := mq.GetConsumer()
+		c := mq.GetConsumer()
 
-			Convey("Then valid consumer should be created", func() {
-				So(c, ShouldNotBeNil)
-				So(c.broker, ShouldNotBeNil)
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_ack_messages_data_"+num), 0)
+		}
+
+		messages, _ := c.Get(10)
+
+		Convey("When ack a subset of the batch", func() {
+			m, _ := mq.broker.newMessage([]byte("not_claimed"), 0, 0)
+			err := c.AckMessages(append(messages[:7:7], m))
+
+			Convey("Then only the subset should be acked", func() {
+				So(err, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 3)
+				for i := range c.notAckedMessages {
+					So(c.notAckedMessages[i].member, ShouldEqual, messages[i+7].member)
+				}
 
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 3)
 			})
 		})
 	})
 }
 
-func TestConsumer_Get(t *testing.T) {
+func TestConsumer_ReQueue(t *testing.T) {
 	Convey("Given created consumer and saved data", t, func() {
-		queueID := "test_consumer_get_mq"
+		queueID := "test_consumer_requeue_mq"
 		redisAddr := "localhost:6379"
 		redisDB := 1
 		cfg := Config{
@@ -116,51 +4331,98 @@ func TestConsumer_Get(t *testing.T) {
 
 		mq, _ := NewPriorityMQ(cfg)
 		defer mq.Close()
-		defer mq.broker.redisClient.Del(queueID)
+		defer mq.Purge()
 
 		c := mq.GetConsumer()
 
 		for i := 0; i < 100; i++ {
 			num := fmt.Sprintf("%03d", i)
-			mq.Put([]byte("consumer_get_data_"+num), 0)
+			mq.Put([]byte("consumer_ack_data_"+num), 0)
 		}
 
-		Convey("When get data with consumer", func() {
-			messages, err := c.Get(10)
+		Convey("When get and ack", func() {
+			c.Get(10)
+			err := c.ReQueue()
 
-			Convey("Then expectd data should be returnedj", func() {
+			Convey("Then acked members should be deleted", func() {
 				So(err, ShouldBeNil)
-				So(len(messages), ShouldEqual, 10)
-
-				for i := range messages {
-					num := fmt.Sprintf("%03d", i)
-					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_data_"+num)
-					So(messages[i].GetPriority(), ShouldEqual, 0)
+				res := mq.broker.redisClient.ZRange(queueID, 0, 99)
+				So(len(res.Val()), ShouldEqual, 100)
+				for i := 90; i < 100; i++ {
+					num := fmt.Sprintf("%03d", i-90)
+					So(string(getBody(res.Val()[i])), ShouldEqual, "consumer_ack_data_"+num)
 				}
+
+				So(len(c.notAckedMessages), ShouldEqual, 0)
+
 			})
 		})
+	})
+}
 
-		Convey("When duplicate get data with consumer", func() {
-			messages, err := c.Get(10)
+func TestConsumer_ReQueuePreserveOrder(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_requeue_preserve_order_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
 
-			Convey("Then expectd data should be returnedj", func() {
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 5; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_requeue_preserve_order_data_"+num), 0)
+		}
+		messages, _ := c.Get(2)
+
+		for i := 5; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_requeue_preserve_order_data_"+num), 0)
+		}
+
+		Convey("When requeue preserving order", func() {
+			err := c.ReQueuePreserveOrder()
+
+			Convey("Then messages should be at their original positions", func() {
 				So(err, ShouldBeNil)
-				So(len(messages), ShouldEqual, 10)
+				So(len(c.notAckedMessages), ShouldEqual, 0)
 
-				for i := range messages {
+				requeued, _ := c.Get(10)
+				So(len(requeued), ShouldEqual, 10)
+				for i := range requeued {
 					num := fmt.Sprintf("%03d", i)
-					So(string(messages[i].GetBody()), ShouldEqual, "consumer_get_data_"+num)
-					So(messages[i].GetPriority(), ShouldEqual, 0)
+					So(string(requeued[i].GetBody()), ShouldEqual, "consumer_requeue_preserve_order_data_"+num)
 				}
+				So(requeued[0].DeliveryCount(), ShouldEqual, 2)
 			})
 		})
 
+		Convey("When requeue preserving order while the original member is still queued", func() {
+			// Simulate a double delivery
+			mq.broker.add(context.Background(), queueID, messages[0])
+			err := c.ReQueuePreserveOrder()
+
+			Convey("Then the message should not be duplicated", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+			})
+		})
 	})
 }
 
-func TestConsumer_Ack(t *testing.T) {
-	Convey("Given created consumer and saved data", t, func() {
-		queueID := "test_consumer_ack_mq"
+func TestConsumer_ReQueueMessages(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_requeue_messages_mq"
 		redisAddr := "localhost:6379"
 		redisDB := 1
 		cfg := Config{
@@ -171,38 +4433,105 @@ func TestConsumer_Ack(t *testing.T) {
 
 		mq, _ := NewPriorityMQ(cfg)
 		defer mq.Close()
-		defer mq.broker.redisClient.Del(queueID)
+		defer mq.Purge()
 
 		c := mq.GetConsumer()
 
-		for i := 0; i < 100; i++ {
+		for i := 0; i < 10; i++ {
 			num := fmt.Sprintf("%03d", i)
-			mq.Put([]byte("consumer_ack_data_"+num), 0)
+			mq.Put([]byte("consumer_requeue_messages_data_"+num), 0)
 		}
 
-		Convey("When get and ack", func() {
-			c.Get(10)
-			err := c.Ack()
+		messages, _ := c.Get(5)
 
-			Convey("Then acked members should be deleted", func() {
+		Convey("When requeue some of claimed messages", func() {
+			m, _ := mq.broker.newMessage([]byte("not_claimed"), 0, 0)
+			err := c.ReQueueMessages(PrioritizedMessages{messages[1], messages[3], m})
+
+			Convey("Then only claimed ones of them should be queued again", func() {
 				So(err, ShouldBeNil)
-				res := mq.broker.redisClient.ZRange(queueID, 0, 99)
-				So(len(res.Val()), ShouldEqual, 90)
-				for i := 0; i < 90; i++ {
-					num := fmt.Sprintf("%03d", i+10)
-					So(string(getBody(res.Val()[i])), ShouldEqual, "consumer_ack_data_"+num)
-				}
+				So(len(c.notAckedMessages), ShouldEqual, 3)
+				So(c.notAckedMessages.contains(messages[1].member), ShouldBeFalse)
+				So(c.notAckedMessages.contains(messages[3].member), ShouldBeFalse)
 
-				So(len(c.notAckedMessages), ShouldEqual, 0)
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 7)
 
+				res := mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 3)
 			})
 		})
 	})
 }
 
-func TestConsumer_ReQueue(t *testing.T) {
-	Convey("Given created consumer and saved data", t, func() {
-		queueID := "test_consumer_requeue_mq"
+func TestConsumer_ReQueueEscalate(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_requeue_escalate_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:            queueID,
+			RedisAddr:       redisAddr,
+			RedisDB:         redisDB,
+			DefaultPriority: 1,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		mq.Put([]byte("consumer_requeue_escalate_data"), 3)
+		c.Get(1)
+
+		Convey("When escalating twice", func() {
+			c.ReQueueEscalate(2)
+			c.Get(1)
+			err := c.ReQueueEscalate(2)
+			messages, _ := c.Get(1)
+
+			Convey("Then priority should be raised on each requeue", func() {
+				So(err, ShouldBeNil)
+				So(messages[0].GetPriority(), ShouldEqual, 7)
+				So(messages[0].DeliveryCount(), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When resetting priority", func() {
+			c.ReQueueEscalate(2)
+			c.Get(1)
+			err := c.ReQueueResetPriority()
+			messages, _ := c.Get(1)
+
+			Convey("Then priority should be the one it was put with", func() {
+				So(err, ShouldBeNil)
+				So(messages[0].GetPriority(), ShouldEqual, 3)
+				So(messages[0].DeliveryCount(), ShouldEqual, 3)
+			})
+		})
+
+		Convey("When resetting priority of a message put at the default priority", func() {
+			c.Ack()
+			mq.PutDefault([]byte("consumer_requeue_escalate_default_data"))
+			c.Get(1)
+			c.ReQueueEscalate(2)
+			c.Get(1)
+			err := c.ReQueueResetPriority()
+			messages, _ := c.Get(1)
+
+			Convey("Then priority should be the default one", func() {
+				So(err, ShouldBeNil)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_requeue_escalate_default_data")
+				So(messages[0].GetPriority(), ShouldEqual, 1)
+			})
+		})
+	})
+}
+
+func TestConsumer_Nack(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_nack_mq"
 		redisAddr := "localhost:6379"
 		redisDB := 1
 		cfg := Config{
@@ -213,30 +4542,167 @@ func TestConsumer_ReQueue(t *testing.T) {
 
 		mq, _ := NewPriorityMQ(cfg)
 		defer mq.Close()
-		defer mq.broker.redisClient.Del(queueID)
+		defer mq.Purge()
 
 		c := mq.GetConsumer()
 
-		for i := 0; i < 100; i++ {
+		for i := 0; i < 20; i++ {
 			num := fmt.Sprintf("%03d", i)
-			mq.Put([]byte("consumer_ack_data_"+num), 0)
+			mq.Put([]byte("consumer_nack_data_"+num), 0)
 		}
 
-		Convey("When get and ack", func() {
-			c.Get(10)
-			err := c.ReQueue()
+		messages, _ := c.Get(10)
 
-			Convey("Then acked members should be deleted", func() {
+		Convey("When nack a single message", func() {
+			err := c.Nack(messages[0])
+
+			Convey("Then the message should be queued again at the tail", func() {
 				So(err, ShouldBeNil)
-				res := mq.broker.redisClient.ZRange(queueID, 0, 99)
-				So(len(res.Val()), ShouldEqual, 100)
-				for i := 90; i < 100; i++ {
-					num := fmt.Sprintf("%03d", i-90)
-					So(string(getBody(res.Val()[i])), ShouldEqual, "consumer_ack_data_"+num)
-				}
+				So(len(c.notAckedMessages), ShouldEqual, 9)
+				So(c.notAckedMessages.contains(messages[0].member), ShouldBeFalse)
+
+				res := mq.broker.redisClient.ZRange(queueID, 0, -1)
+				So(len(res.Val()), ShouldEqual, 11)
+				So(string(getBody(res.Val()[10])), ShouldEqual, "consumer_nack_data_000")
+
+				res = mq.broker.redisClient.ZRange(queueID+processingSuffix, 0, -1)
+				So(len(res.Val()), ShouldEqual, 9)
+			})
+		})
+
+		Convey("When nack a message which is not claimed", func() {
+			m, _ := mq.broker.newMessage([]byte("not_claimed"), 0, 0)
+			err := c.Nack(m)
+
+			Convey("Then nothing should be changed", func() {
+				So(err, ShouldBeNil)
+				So(len(c.notAckedMessages), ShouldEqual, 10)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
+			})
+		})
+	})
+}
+
+func BenchmarkMessageQueue_Put(b *testing.B) {
+	queueID := "bench_put_mq"
+	mq, _ := NewPriorityMQ(Config{
+		Name:      queueID,
+		RedisAddr: "localhost:6379",
+		RedisDB:   1,
+	})
+	defer mq.Close()
+	defer mq.Purge()
+
+	body := []byte("bench_put_data")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 1000; j++ {
+			mq.Put(body, 0)
+		}
+	}
+}
+
+func BenchmarkMessageQueue_PutBatch(b *testing.B) {
+	queueID := "bench_put_batch_mq"
+	mq, _ := NewPriorityMQ(Config{
+		Name:      queueID,
+		RedisAddr: "localhost:6379",
+		RedisDB:   1,
+	})
+	defer mq.Close()
+	defer mq.Purge()
+
+	bodies := make([][]byte, 1000)
+	priorities := make([]float64, 1000)
+	for i := range bodies {
+		bodies[i] = []byte("bench_put_batch_data")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mq.PutBatch(bodies, priorities)
+	}
+}
+
+func BenchmarkConsumer_Ack(b *testing.B) {
+	queueID := "bench_ack_mq"
+	mq, _ := NewPriorityMQ(Config{
+		Name:      queueID,
+		RedisAddr: "localhost:6379",
+		RedisDB:   1,
+	})
+	defer mq.Close()
+	defer mq.Purge()
+
+	bodies := make([][]byte, 1000)
+	priorities := make([]float64, 1000)
+	for i := range bodies {
+		bodies[i] = []byte("bench_ack_data")
+	}
+	c := mq.GetConsumer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mq.PutBatch(bodies, priorities)
+		c.Get(1000)
+		b.StartTimer()
+
+		c.Ack()
+	}
+}
+
+func TestConsumer_ReQueueAfter(t *testing.T) {
+	Convey("Given created consumer and claimed data", t, func() {
+		queueID := "test_consumer_requeue_after_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		c := mq.GetConsumer()
+
+		for i := 0; i < 10; i++ {
+			num := fmt.Sprintf("%03d", i)
+			mq.Put([]byte("consumer_requeue_after_data_"+num), 0)
+		}
+		c.Get(5)
 
+		Convey("When requeue with delay", func() {
+			err := c.ReQueueAfter(300 * time.Millisecond)
+
+			Convey("Then messages should not be delivered until delay elapses", func() {
+				So(err, ShouldBeNil)
 				So(len(c.notAckedMessages), ShouldEqual, 0)
 
+				messages, _ := c.Get(10)
+				So(len(messages), ShouldEqual, 5)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_requeue_after_data_005")
+				c.Ack()
+
+				time.Sleep(400 * time.Millisecond)
+
+				messages, _ = c.Get(10)
+				So(len(messages), ShouldEqual, 5)
+				So(string(messages[0].GetBody()), ShouldEqual, "consumer_requeue_after_data_000")
+			})
+		})
+
+		Convey("When requeue with zero delay", func() {
+			err := c.ReQueueAfter(0)
+
+			Convey("Then messages should be queued again immediately", func() {
+				So(err, ShouldBeNil)
+
+				l, _ := mq.Len()
+				So(l, ShouldEqual, 10)
 			})
 		})
 	})
@@ -0,0 +1,78 @@
+//go:build prometheus
+// +build prometheus
+
+package mq
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "pmq"
+
+type metricsCollector struct {
+	mq *MessageQueue
+
+	len         *prometheus.Desc
+	deadLetters *prometheus.Desc
+	put         *prometheus.Desc
+	gotten      *prometheus.Desc
+	acked       *prometheus.Desc
+	reQueued    *prometheus.Desc
+}
+
+// MetricsCollector returns a prometheus collector reporting Stats and the size of the dead letter queue.
+// Metrics are labeled with the redis key of the queue.
+// It is built only with the prometheus build tag.
+func (mq *MessageQueue) MetricsCollector() prometheus.Collector {
+	labels := prometheus.Labels{"queue": mq.broker.id}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, nil, labels)
+	}
+
+	return &metricsCollector{
+		mq:          mq,
+		len:         desc("len", "Number of messages waiting in the queue."),
+		deadLetters: desc("dead_letters", "Number of messages in the dead letter queue."),
+		put:         desc("put_total", "Total number of messages put."),
+		gotten:      desc("gotten_total", "Total number of messages gotten."),
+		acked:       desc("acked_total", "Total number of messages acked."),
+		reQueued:    desc("requeued_total", "Total number of messages queued again."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.len
+	ch <- c.deadLetters
+	ch <- c.put
+	ch <- c.gotten
+	ch <- c.acked
+	ch <- c.reQueued
+}
+
+// Collect implements prometheus.Collector.
+// Sizes which can't be fetched from redis are not reported.
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.mq.Stats()
+	if stats.Len >= 0 {
+		ch <- prometheus.MustNewConstMetric(c.len, prometheus.GaugeValue, float64(stats.Len))
+	}
+
+	b := c.mq.broker
+	var dead int64
+	err := b.withContext(context.Background(), func(rc redisCmdable) error {
+		var err error
+		dead, err = rc.ZCard(b.deadID).Result()
+		return err
+	})
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(c.deadLetters, prometheus.GaugeValue, float64(dead))
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.put, prometheus.CounterValue, float64(stats.Put))
+	ch <- prometheus.MustNewConstMetric(c.gotten, prometheus.CounterValue, float64(stats.Gotten))
+	ch <- prometheus.MustNewConstMetric(c.acked, prometheus.CounterValue, float64(stats.Acked))
+	ch <- prometheus.MustNewConstMetric(c.reQueued, prometheus.CounterValue, float64(stats.ReQueued))
+}
@@ -0,0 +1,47 @@
+//go:build prometheus
+// +build prometheus
+
+package mq
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessageQueue_MetricsCollector(t *testing.T) {
+	Convey("Given created mq and saved data", t, func() {
+		queueID := "test_metrics_collector_mq"
+		redisAddr := "localhost:6379"
+		redisDB := 1
+		cfg := Config{
+			Name:      queueID,
+			RedisAddr: redisAddr,
+			RedisDB:   redisDB,
+		}
+
+		mq, _ := NewPriorityMQ(cfg)
+		defer mq.Close()
+		defer mq.Purge()
+
+		mq.Put([]byte("metrics_collector_data"), 0)
+
+		Convey("When collecting metrics", func() {
+			collector := mq.MetricsCollector()
+
+			descC := make(chan *prometheus.Desc, 10)
+			collector.Describe(descC)
+			close(descC)
+
+			metricC := make(chan prometheus.Metric, 10)
+			collector.Collect(metricC)
+			close(metricC)
+
+			Convey("Then all described metrics should be collected", func() {
+				So(len(descC), ShouldEqual, 6)
+				So(len(metricC), ShouldEqual, 6)
+			})
+		})
+	})
+}